@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+)
+
+// accountStateFile keeps, next to cfg.json, which device account is active
+// and which daemon account name belongs to which account index.
+const accountStateFile = "./accounts.json"
+
+type accountRecord struct {
+	Index   uint32
+	Address string
+}
+
+type accountState struct {
+	Active   uint32
+	Accounts map[string]accountRecord
+}
+
+func loadAccountState() (*accountState, error) {
+	state := &accountState{Accounts: make(map[string]accountRecord)}
+	data, err := ioutil.ReadFile(accountStateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Accounts == nil {
+		state.Accounts = make(map[string]accountRecord)
+	}
+	return state, nil
+}
+
+func (s *accountState) save() error {
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(accountStateFile, data, 0600)
+}
+
+// resolveAccount turns a switchkey argument into an account index: either
+// a number or the name an account was imported under.
+func (s *accountState) resolveAccount(arg string) (uint32, bool) {
+	if rec, ok := s.Accounts[arg]; ok {
+		return rec.Index, true
+	}
+	index, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(index), true
+}
+
+// warnIfInactive warns when the daemon account about to be used is not the
+// one active on the device, as transactions would be signed with the wrong
+// key.
+func warnIfInactive(accountName string) {
+	state, err := loadAccountState()
+	if err != nil {
+		log.Println("Warning: couldn't read", accountStateFile+":", err)
+		return
+	}
+	rec, ok := state.Accounts[accountName]
+	if !ok {
+		log.Printf("Warning: account %q was not imported from this device, can't tell which key it uses (run importacc -index n %s to record it)", accountName, accountName)
+	} else if rec.Index != state.Active {
+		log.Printf("Warning: account %q uses key %d but key %d is active on the device (run switchkey %s)", accountName, rec.Index, state.Active, accountName)
+	}
+}
+
+// useAccountKey makes the key the daemon account was imported from the
+// active one on the device, so its key images and signatures are made
+// with the right key. Accounts missing from accounts.json, e.g. imported
+// from another machine, keep the active key with a warning.
+func useAccountKey(nanos *NanoS, accountName string) error {
+	state, err := loadAccountState()
+	if err != nil {
+		log.Println("Warning: couldn't read", accountStateFile+":", err)
+		return nil
+	}
+	rec, ok := state.Accounts[accountName]
+	if !ok {
+		warnIfInactive(accountName)
+		return nil
+	}
+	if err := nanos.SwitchKey(rec.Index); err != nil {
+		return err
+	}
+	if state.Active != rec.Index {
+		state.Active = rec.Index
+		return state.save()
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/incognitochain/incognito-chain/common"
+	"github.com/incognitochain/incognito-chain/privacy"
+	"github.com/incognitochain/incognito-chain/privacy/operation"
+)
+
+// Test coin used by the key image benchmarks.
+const (
+	benchCoinPubkey = "17fd6aff8fecd18243af1a83dab0e47ca5fafec256ba497b3136a6b3f68eecb1"
+	benchEncryptKm  = "c4541151e39bb43e7b00ad6a1d999d609f5939ca622a9db7b7391c5190eea909"
+)
+
+// benchConfig controls a benchmark run.
+type benchConfig struct {
+	Iterations int
+	Warmup     int
+	// BatchSizes lists the coin counts KeyImageBatch is measured with.
+	BatchSizes []int
+	// Commands restricts the run to these benchmark names; empty means
+	// every non-interactive one.
+	Commands []string
+	// Interactive includes commands that wait for approval on the device.
+	Interactive bool
+}
+
+// benchCase is one APDU to measure. setup runs before every iteration and
+// is not timed; it puts the app in the state the command needs.
+type benchCase struct {
+	name        string
+	ins, p1, p2 byte
+	payload     []byte
+	setup       func(n *NanoS) error
+	interactive bool
+}
+
+// LatencyStats summarises a set of durations.
+type LatencyStats struct {
+	Count  int
+	Min    time.Duration
+	Median time.Duration
+	P95    time.Duration
+	Max    time.Duration
+}
+
+// BenchResult is the outcome of one benchCase.
+type BenchResult struct {
+	Command      string
+	PayloadBytes int
+	APDU         LatencyStats
+	// Packet is only set for transports that expose packet timings (HID).
+	Packet *LatencyStats `json:",omitempty"`
+	Error  string        `json:",omitempty"`
+}
+
+// BenchReport is everything a benchmark run produced, written as JSON with
+// -json so runs on different firmware and app versions can be compared.
+type BenchReport struct {
+	Time       time.Time
+	CLIVersion string
+	AppVersion string
+	Iterations int
+	Warmup     int
+	Results    []BenchResult
+}
+
+func newLatencyStats(ds []time.Duration) LatencyStats {
+	if len(ds) == 0 {
+		return LatencyStats{}
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p95 := (len(sorted)*95+99)/100 - 1
+	return LatencyStats{
+		Count:  len(sorted),
+		Min:    sorted[0],
+		Median: sorted[len(sorted)/2],
+		P95:    sorted[p95],
+		Max:    sorted[len(sorted)-1],
+	}
+}
+
+// parseSizes parses a comma-separated list of KeyImageBatch sizes, which
+// must be between 1 and keyImageBatchSize.
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q", f)
+		} else if n < 1 || n > keyImageBatchSize {
+			return nil, fmt.Errorf("invalid size %d: must be between 1 and %d", n, keyImageBatchSize)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// benchCases builds a case for every instruction in const.go.
+func benchCases(cfg benchConfig) []benchCase {
+	km, _ := hex.DecodeString(benchEncryptKm)
+	coinPub, _ := hex.DecodeString(benchCoinPubkey)
+	pedRandom := operation.PedCom.G[operation.PedersenRandomnessIndex].GetKey()
+	pedPrivate := operation.PedCom.G[operation.PedersenPrivateKeyIndex].GetKey()
+	r := new(privacy.Scalar).FromUint64(1)
+	hash := common.HashH([]byte("incognitoledger benchmark"))
+
+	signPayload := new(bytes.Buffer)
+	signPayload.Write(pedRandom[:])
+	signPayload.Write(pedPrivate[:])
+	signPayload.Write(r.ToBytesS())
+	signPayload.Write(hash.Bytes())
+
+	genAlpha := func(n *NanoS) error {
+		return n.GenerateAlpha(2)
+	}
+	genCoinKey := func(n *NanoS) error {
+		if err := genAlpha(n); err != nil {
+			return err
+		}
+		_, err := n.Exchange(cmdGenCoinPrivateKey, 0, 0, km)
+		return err
+	}
+	// SwitchKey re-selects the key already active, so the run leaves the
+	// device as it found it
+	active := uint32(0)
+	if state, err := loadAccountState(); err == nil {
+		active = state.Active
+	}
+
+	cases := []benchCase{
+		{name: "GetVersion", ins: cmdGetVersion},
+		{name: "TrustHost", ins: cmdTrustHost},
+		{name: "GetAddress", ins: cmdGetAddress, payload: encodeIndex(0)},
+		{name: "GetViewKey", ins: cmdGetViewKey, payload: encodeIndex(0)},
+		{name: "GetOTAKey", ins: cmdGetOTAKey, payload: encodeIndex(0)},
+		{name: "GetValidatorKey", ins: cmdGetValidatorKey, payload: encodeIndex(0)},
+		{name: "GetPrivateKey", ins: cmdGetPrivateKey, payload: encodeIndex(0)},
+		{name: "SwitchKey", ins: cmdSwitchKey, payload: encodeIndex(active)},
+		{name: "KeyImage", ins: cmdKeyImage, payload: append(append([]byte{}, km...), coinPub...)},
+	}
+	for _, size := range cfg.BatchSizes {
+		payload := bytes.Repeat(append(append([]byte{}, km...), coinPub...), size)
+		cases = append(cases, benchCase{name: fmt.Sprintf("KeyImageBatch/%d", size), ins: cmdKeyImageBatch, p2: byte(size), payload: payload})
+	}
+	cases = append(cases,
+		benchCase{name: "GenAlpha", ins: cmdGenAlpha, p1: 2},
+		benchCase{name: "GenCoinPrivateKey", ins: cmdGenCoinPrivateKey, payload: km, setup: genAlpha},
+		benchCase{name: "CalculateC", ins: cmdCalculateC, payload: pedPrivate[:], setup: genCoinKey},
+		benchCase{name: "CalculateR", ins: cmdCalculateR, payload: km, setup: genCoinKey},
+		benchCase{name: "SignSchnorr", ins: cmdSignSchnorr, payload: signPayload.Bytes()},
+		benchCase{name: "SignHash", ins: cmdSignHash, p2: p2SignHash, payload: append(encodeIndex(0), hash.Bytes()...), interactive: true},
+	)
+
+	var selected []benchCase
+	for _, c := range cases {
+		if len(cfg.Commands) > 0 {
+			for _, name := range cfg.Commands {
+				if strings.EqualFold(name, c.name) || strings.EqualFold(name, strings.SplitN(c.name, "/", 2)[0]) {
+					selected = append(selected, c)
+					break
+				}
+			}
+		} else if !c.interactive || cfg.Interactive {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
+
+func runBenchmark(n *NanoS, cfg benchConfig) *BenchReport {
+	report := &BenchReport{
+		Time:       time.Now().UTC(),
+		CLIVersion: CLI_version,
+		Iterations: cfg.Iterations,
+		Warmup:     cfg.Warmup,
+	}
+	if v, err := n.GetVersion(); err == nil {
+		report.AppVersion = v
+	}
+	if err := n.TrustHost(); err != nil {
+		report.Results = append(report.Results, BenchResult{Command: "TrustHost", Error: err.Error()})
+		return report
+	}
+	for _, c := range benchCases(cfg) {
+		report.Results = append(report.Results, runBenchCase(n, c, cfg))
+	}
+	return report
+}
+
+func runBenchCase(n *NanoS, c benchCase, cfg benchConfig) BenchResult {
+	result := BenchResult{
+		Command:      c.name,
+		PayloadBytes: len(c.payload),
+	}
+	var apdus, packets []time.Duration
+	var recording bool
+	hasPackets := n.observePackets(func(d time.Duration) {
+		if recording {
+			packets = append(packets, d)
+		}
+	})
+	defer n.observePackets(nil)
+
+	for i := 0; i < cfg.Warmup+cfg.Iterations; i++ {
+		if c.setup != nil {
+			if err := c.setup(n); err != nil {
+				result.Error = err.Error()
+				break
+			}
+		}
+		recording = i >= cfg.Warmup
+		start := time.Now()
+		_, err := n.Exchange(c.ins, c.p1, c.p2, c.payload)
+		elapsed := time.Since(start)
+		recording = false
+		if err != nil {
+			result.Error = err.Error()
+			break
+		}
+		if i >= cfg.Warmup {
+			apdus = append(apdus, elapsed)
+		}
+	}
+	result.APDU = newLatencyStats(apdus)
+	if hasPackets {
+		stats := newLatencyStats(packets)
+		result.Packet = &stats
+	}
+	return result
+}
+
+func (r *BenchReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(r)
+}
+
+func (r *BenchReport) writeTable(w io.Writer) error {
+	fmt.Fprintf(w, "CLI %s, app %s, %d iterations after %d warmup\n\n", r.CLIVersion, r.AppVersion, r.Iterations, r.Warmup)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "command\tbytes\tmin\tmedian\tp95\tmax\tpacket median\tpacket p95\t")
+	for _, res := range r.Results {
+		if res.Error != "" {
+			fmt.Fprintf(tw, "%s\t%d\terror: %s\t\t\t\t\t\t\n", res.Command, res.PayloadBytes, res.Error)
+			continue
+		}
+		packetMedian, packetP95 := "-", "-"
+		if res.Packet != nil {
+			packetMedian, packetP95 = res.Packet.Median.String(), res.Packet.P95.String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%v\t%v\t%v\t%s\t%s\t\n", res.Command, res.PayloadBytes,
+			res.APDU.Min, res.APDU.Median, res.APDU.P95, res.APDU.Max, packetMedian, packetP95)
+	}
+	return tw.Flush()
+}
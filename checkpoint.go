@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+)
+
+// balanceCheckpoint keeps the key images updatebalance decrypted but the
+// daemon hasn't confirmed yet, so an interrupted run doesn't have to ask
+// the device for them again.
+type balanceCheckpoint struct {
+	path string
+	// Decrypted maps token ID and coin public key to the key image (hex).
+	Decrypted map[string]map[string]string
+}
+
+func checkpointPath(account string) string {
+	return "./updatebalance-" + url.PathEscape(account) + ".json"
+}
+
+func loadCheckpoint(account string) (*balanceCheckpoint, error) {
+	cp := &balanceCheckpoint{
+		path:      checkpointPath(account),
+		Decrypted: make(map[string]map[string]string),
+	}
+	data, err := ioutil.ReadFile(cp.path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	if cp.Decrypted == nil {
+		cp.Decrypted = make(map[string]map[string]string)
+	}
+	return cp, nil
+}
+
+// prune drops the coins the daemon no longer lists as undecrypted, whose
+// key images it stored even if the run that sent them never learned it.
+func (cp *balanceCheckpoint) prune(listed map[string]map[string]string) {
+	for tokenID, kis := range cp.Decrypted {
+		for coinPk := range kis {
+			if _, ok := listed[tokenID][coinPk]; !ok {
+				delete(kis, coinPk)
+			}
+		}
+		if len(kis) == 0 {
+			delete(cp.Decrypted, tokenID)
+		}
+	}
+}
+
+func (cp *balanceCheckpoint) keyImage(tokenID, coinPubkey string) (string, bool) {
+	ki, ok := cp.Decrypted[tokenID][coinPubkey]
+	return ki, ok
+}
+
+func (cp *balanceCheckpoint) add(tokenID, coinPubkey, keyImage string) {
+	if cp.Decrypted[tokenID] == nil {
+		cp.Decrypted[tokenID] = make(map[string]string)
+	}
+	cp.Decrypted[tokenID][coinPubkey] = keyImage
+}
+
+// unconfirmed returns a copy of the key images of tokenID still to submit.
+func (cp *balanceCheckpoint) unconfirmed(tokenID string) map[string]string {
+	kis := make(map[string]string, len(cp.Decrypted[tokenID]))
+	for coinPk, ki := range cp.Decrypted[tokenID] {
+		kis[coinPk] = ki
+	}
+	return kis
+}
+
+// confirm drops the submitted key images the daemon answered for. Rejected
+// ones are dropped to be decrypted again. The others only count as stored
+// if the daemon accounted for every key image sent; otherwise they stay to
+// be submitted again, and confirm returns false.
+func (cp *balanceCheckpoint) confirm(tokenID string, sent map[string]string, result *KeyImageSubmitResult) bool {
+	kis := cp.Decrypted[tokenID]
+	for coinPk := range result.Rejected {
+		delete(kis, coinPk)
+	}
+	confirmed := result.Accepted+len(result.Rejected) == len(sent)
+	if confirmed {
+		for coinPk := range sent {
+			delete(kis, coinPk)
+		}
+	}
+	if len(kis) == 0 {
+		delete(cp.Decrypted, tokenID)
+	}
+	return confirmed
+}
+
+func (cp *balanceCheckpoint) save() error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// write then rename, so a crash never leaves a truncated checkpoint
+	tmp := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cp.path)
+}
+
+// finish deletes the checkpoint once every key image was confirmed.
+func (cp *balanceCheckpoint) finish() error {
+	if len(cp.Decrypted) > 0 {
+		return cp.save()
+	}
+	if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
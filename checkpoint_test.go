@@ -0,0 +1,112 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// countingDevice is the test device, counting the key image batches it
+// computes and failing those past failAfter, if set.
+func countingDevice(t *testing.T, batches *int32, failAfter int32) *NanoS {
+	emu := newTestEmulator(t)
+	return NewNanoS(TransportFunc(func(ctx context.Context, apdu APDU) ([]byte, error) {
+		if apdu.INS == cmdKeyImageBatch {
+			if n := atomic.AddInt32(batches, 1); failAfter > 0 && n > failAfter {
+				return nil, errors.New("device unplugged")
+			}
+		}
+		return emu.Exchange(ctx, apdu)
+	}))
+}
+
+func TestUpdateBalanceResumes(t *testing.T) {
+	defer inTempDir(t)()
+	mock := NewMockDaemon()
+	mock.CoinsPerImport = keyImageBatchSize + 3
+	var submitDown int32 = 1
+	daemon, srv := startMockDaemon(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/submitkeyimages" && atomic.LoadInt32(&submitDown) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	nanos := newTestDevice(t)
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	nanos.Close()
+
+	// the device fails on the second batch and nothing can be submitted:
+	// the first batch is kept
+	var batches int32
+	nanos = countingDevice(t, &batches, 1)
+	if _, err := requestUpdateBalance(ctx, nanos, daemon, "testacc"); err == nil {
+		t.Fatal("updatebalance succeeded with the device failing")
+	}
+	nanos.Close()
+	checkpoint, err := loadCheckpoint("testacc")
+	if err != nil {
+		t.Fatal(err)
+	} else if n := len(checkpoint.Decrypted[mockPRVTokenID]); n != keyImageBatchSize {
+		t.Fatalf("checkpoint holds %d key images, want %d", n, keyImageBatchSize)
+	}
+
+	atomic.StoreInt32(&submitDown, 0)
+	batches = 0
+	nanos = countingDevice(t, &batches, 0)
+	defer nanos.Close()
+	if updated, err := requestUpdateBalance(ctx, nanos, daemon, "testacc"); err != nil {
+		t.Fatal(err)
+	} else if updated != mock.CoinsPerImport {
+		t.Fatalf("%d coins accepted, want %d", updated, mock.CoinsPerImport)
+	}
+	if batches != 1 {
+		t.Fatalf("resumed run decrypted %d batches, want 1", batches)
+	}
+	if _, err := os.Stat(checkpointPath("testacc")); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint left after a complete run: %v", err)
+	}
+}
+
+func TestUpdateBalanceUnconfirmed(t *testing.T) {
+	defer inTempDir(t)()
+	mock := NewMockDaemon()
+	mock.CoinsPerImport = 3
+	// a daemon that answers without saying what it stored
+	daemon, srv := startMockDaemon(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/submitkeyimages" {
+			writeJSON(w, struct{}{})
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if updated, err := requestUpdateBalance(ctx, nanos, daemon, "testacc"); err != nil {
+		t.Fatal(err)
+	} else if updated != 0 {
+		t.Fatalf("%d coins accepted, want 0", updated)
+	}
+	checkpoint, err := loadCheckpoint("testacc")
+	if err != nil {
+		t.Fatal(err)
+	} else if n := len(checkpoint.Decrypted[mockPRVTokenID]); n != mock.CoinsPerImport {
+		t.Fatalf("checkpoint holds %d unconfirmed key images, want %d", n, mock.CoinsPerImport)
+	}
+}
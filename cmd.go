@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"sync/atomic"
 )
 
 func (n *NanoS) GetVersion() (version string, err error) {
@@ -27,11 +29,16 @@ func (n *NanoS) TrustHost() error {
 	return nil
 }
 
-func (n *NanoS) GetAddress() (addr string, err error) {
-	// encIndex := make([]byte, 4)
-	// binary.LittleEndian.PutUint32(encIndex, index)
+// encodeIndex encodes an account index as the little-endian payload the
+// key-returning commands expect.
+func encodeIndex(index uint32) []byte {
+	encIndex := make([]byte, 4)
+	binary.LittleEndian.PutUint32(encIndex, index)
+	return encIndex
+}
 
-	resp, err := n.Exchange(cmdGetAddress, 0, 0, nil)
+func (n *NanoS) GetAddress(index uint32) (addr string, err error) {
+	resp, err := n.Exchange(cmdGetAddress, 0, 0, encodeIndex(index))
 	if err != nil {
 		return
 	}
@@ -40,18 +47,25 @@ func (n *NanoS) GetAddress() (addr string, err error) {
 	return
 }
 
-func (n *NanoS) GetPrivateKey() (priv string, err error) {
-	resp, err := n.Exchange(cmdGetPrivateKey, 0, 0, nil)
-	if err != nil {
-		return
+// ErrAddressRejected is returned by VerifyAddress when the user reports that
+// the address shown on the device does not match.
+var ErrAddressRejected = errors.New("address rejected on the device, do not use it")
+
+// VerifyAddress shows the payment address of the account with the given
+// index on the device screen and waits for the user to approve it, so the
+// address can be trusted even if the host is compromised.
+func (n *NanoS) VerifyAddress(index uint32) (addr string, err error) {
+	resp, err := n.Exchange(cmdGetAddress, p1Confirm, p2DisplayAddress, encodeIndex(index))
+	if errors.Is(err, ErrUserRejected) {
+		return "", ErrAddressRejected
+	} else if err != nil {
+		return "", err
 	}
-	fmt.Println("privatekey:", string(resp))
-	priv = string(resp)
-	return
+	return string(resp), nil
 }
 
-func (n *NanoS) GetViewKey() (string, error) {
-	resp, err := n.Exchange(cmdGetViewKey, 0, 0, nil)
+func (n *NanoS) GetViewKey(index uint32) (string, error) {
+	resp, err := n.Exchange(cmdGetViewKey, 0, 0, encodeIndex(index))
 	if err != nil {
 		return "", err
 	}
@@ -59,8 +73,8 @@ func (n *NanoS) GetViewKey() (string, error) {
 	return hex.EncodeToString(resp), nil
 }
 
-func (n *NanoS) GetOTAKey() (string, error) {
-	resp, err := n.Exchange(cmdGetOTAKey, 0, 0, nil)
+func (n *NanoS) GetOTAKey(index uint32) (string, error) {
+	resp, err := n.Exchange(cmdGetOTAKey, 0, 0, encodeIndex(index))
 	if err != nil {
 		return "", err
 	}
@@ -68,46 +82,122 @@ func (n *NanoS) GetOTAKey() (string, error) {
 	return hex.EncodeToString(resp), nil
 }
 
-func (n *NanoS) GetValidatorKey() error {
-	resp, err := n.Exchange(cmdGetValidatorKey, 0, 0, nil)
+// GetValidatorKey returns the mining key seed of the account with the given
+// index; see deriveValidatorKeys for the keys a node derives from it.
+func (n *NanoS) GetValidatorKey(index uint32) ([]byte, error) {
+	resp, err := n.Exchange(cmdGetValidatorKey, 0, 0, encodeIndex(index))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_ = resp
-	return nil
+	return resp, nil
 }
 
-func (n *NanoS) SwitchKey() error {
-	buf := new(bytes.Buffer)
-
-	bs, _ := hex.DecodeString("")
-	buf.Write(bs)
-	resp, err := n.Exchange(cmdSwitchKey, 0, 0, buf.Next(255))
+// SwitchKey makes the account with the given index the one the device
+// signs with. The app forgets it when restarted, so Reconnect selects it
+// again.
+func (n *NanoS) SwitchKey(index uint32) error {
+	_, err := n.Exchange(cmdSwitchKey, 0, 0, encodeIndex(index))
 	if err != nil {
 		return err
 	}
-	_ = resp
+	atomic.StoreInt64(&n.state.activeKey, int64(index))
 	return nil
 }
 
 func (n *NanoS) GenKeyImage(coinPubkey string, encryptKm string) (string, error) {
 	buf := new(bytes.Buffer)
-	bs, err := hex.DecodeString(encryptKm)
+	if err := writeKeyImageRequest(buf, KeyImageRequest{coinPubkey, encryptKm}); err != nil {
+		return "", err
+	}
+
+	resp, err := n.Exchange(cmdKeyImage, 0, 0, buf.Bytes())
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	buf.Write(bs)
-	bs1, err := hex.DecodeString(coinPubkey)
+	return hex.EncodeToString(resp), nil
+}
+
+// keyImageBatchSize is how many key images are computed per batched
+// exchange; their 32-byte results must fit in one APDU response.
+const keyImageBatchSize = 7
+
+// KeyImageRequest identifies a coin whose key image is wanted, as returned
+// by the daemon's /getcoinstodecrypt (both fields hex).
+type KeyImageRequest struct {
+	CoinPubkey string
+	EncryptKm  string
+}
+
+func writeKeyImageRequest(buf *bytes.Buffer, coin KeyImageRequest) error {
+	km, err := hex.DecodeString(coin.EncryptKm)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	buf.Write(bs1)
+	pub, err := hex.DecodeString(coin.CoinPubkey)
+	if err != nil {
+		return err
+	}
+	if len(km) != 32 || len(pub) != 32 {
+		return errors.New("coin public key and encrypted km must be 32 bytes")
+	}
+	buf.Write(km)
+	buf.Write(pub)
+	return nil
+}
+
+// GenKeyImages returns the hex key images of coins, in order. Coins are
+// sent keyImageBatchSize at a time in a single (chunked) exchange; app
+// versions without the batched command fall back to one exchange per coin.
+func (n *NanoS) GenKeyImages(coins []KeyImageRequest) ([]string, error) {
+	result := make([]string, 0, len(coins))
+	for len(coins) > 0 {
+		batch := coins
+		if len(batch) > keyImageBatchSize {
+			batch = batch[:keyImageBatchSize]
+		}
+		coins = coins[len(batch):]
 
-	resp, err := n.Exchange(cmdKeyImage, 0, 0, buf.Next(255))
+		if atomic.LoadInt32(&n.state.noBatchKeyImage) == 0 {
+			kis, err := n.genKeyImageBatch(batch)
+			if err == nil {
+				result = append(result, kis...)
+				continue
+			} else if !errors.Is(err, ErrINSNotSupported) {
+				return nil, err
+			}
+			atomic.StoreInt32(&n.state.noBatchKeyImage, 1)
+		}
+		for _, coin := range batch {
+			ki, err := n.GenKeyImage(coin.CoinPubkey, coin.EncryptKm)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, ki)
+		}
+	}
+	return result, nil
+}
+
+// genKeyImageBatch sends encryptKm || coinPubkey for every coin, with the
+// number of coins in P2, and splits the concatenated key images.
+func (n *NanoS) genKeyImageBatch(coins []KeyImageRequest) ([]string, error) {
+	buf := new(bytes.Buffer)
+	for _, coin := range coins {
+		if err := writeKeyImageRequest(buf, coin); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := n.Exchange(cmdKeyImageBatch, 0, byte(len(coins)), buf.Bytes())
 	if err != nil {
-		return "", err
+		return nil, err
+	} else if len(resp) != 32*len(coins) {
+		return nil, fmt.Errorf("device returned %d bytes for %d key images", len(resp), len(coins))
 	}
-	return hex.EncodeToString(resp), nil
+	kis := make([]string, len(coins))
+	for i := range kis {
+		kis[i] = hex.EncodeToString(resp[i*32 : (i+1)*32])
+	}
+	return kis, nil
 }
 
 //This func contain a set of commands for ledger
@@ -125,7 +215,7 @@ func (n *NanoS) CalculateFirstC(Rpi [][]byte, PedComG []byte) ([]byte, error) {
 	for i := 0; i < len(Rpi)-1; i++ {
 		buf.Reset()
 		buf.Write(Rpi[i])
-		resp, err := n.Exchange(cmdCalculateC, 0, byte(i), buf.Next(255))
+		resp, err := n.Exchange(cmdCalculateC, 0, byte(i), buf.Bytes())
 		if err != nil {
 			return nil, err
 		}
@@ -135,7 +225,7 @@ func (n *NanoS) CalculateFirstC(Rpi [][]byte, PedComG []byte) ([]byte, error) {
 
 	buf.Reset()
 	buf.Write(PedComG)
-	resp, err := n.Exchange(cmdCalculateC, 1, byte(len(Rpi)-1), buf.Next(255))
+	resp, err := n.Exchange(cmdCalculateC, 1, byte(len(Rpi)-1), buf.Bytes())
 	if err != nil {
 		return nil, err
 	}
@@ -149,7 +239,7 @@ func (n *NanoS) CalculateR(coinLength int, cPi []byte) ([][]byte, error) {
 	for idx := 0; idx < coinLength; idx++ {
 		buf.Reset()
 		buf.Write(cPi)
-		resp, err := n.Exchange(cmdCalculateR, 0, byte(idx), buf.Next(255))
+		resp, err := n.Exchange(cmdCalculateR, 0, byte(idx), buf.Bytes())
 		if err != nil {
 			return nil, err
 		}
@@ -165,12 +255,12 @@ func (n *NanoS) GenCoinPrivateKey(coinsH [][]byte) error {
 		buf.Reset()
 		buf.Write(coinH)
 		if idx == len(coinsH)-1 { //add sumRand privkey
-			_, err := n.Exchange(cmdGenCoinPrivateKey, 1, byte(idx), buf.Next(255))
+			_, err := n.Exchange(cmdGenCoinPrivateKey, 1, byte(idx), buf.Bytes())
 			if err != nil {
 				return err
 			}
 		} else {
-			_, err := n.Exchange(cmdGenCoinPrivateKey, 0, byte(idx), buf.Next(255))
+			_, err := n.Exchange(cmdGenCoinPrivateKey, 0, byte(idx), buf.Bytes())
 			if err != nil {
 				return err
 			}
@@ -190,7 +280,7 @@ func (n *NanoS) SignSchnorr(pedRandom []byte, pedPrivate []byte, randomness []by
 	buf.Write(randomness)
 	buf.Write(message)
 
-	resp, err := n.Exchange(cmdSignSchnorr, 0, 0, buf.Next(255))
+	resp, err := n.Exchange(cmdSignSchnorr, 0, 0, buf.Bytes())
 	if err != nil {
 		return nil, err
 	}
@@ -198,3 +288,22 @@ func (n *NanoS) SignSchnorr(pedRandom []byte, pedPrivate []byte, randomness []by
 
 	return resp, nil
 }
+
+// SignHash shows a 32-byte hash on the device and, once the user approves
+// it, returns a Schnorr signature over it made with the key of the account
+// with the given index. The signature verifies against the account's
+// payment address public key (see verifyHashSignature).
+func (n *NanoS) SignHash(index uint32, hash []byte) ([]byte, error) {
+	if len(hash) != 32 {
+		return nil, errors.New("hash must be 32 bytes")
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(encodeIndex(index))
+	buf.Write(hash)
+
+	resp, err := n.Exchange(cmdSignHash, 0, p2SignHash, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -1,27 +1,81 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"time"
 )
 
-var COINDAEMONADDR string
-
-func init() {
-	COINDAEMONADDR = DefaultCoinDaemonAddr
+// Config is the content of cfg.json.
+type Config struct {
+	// CoinDaemon is the address of the CoinDaemon, host:port or an
+	// http:// or https:// URL.
+	CoinDaemon string `json:"coindaemon"`
+	// TLS configures https:// connections to the CoinDaemon.
+	TLS *DaemonTLSConfig `json:"tls"`
+	// Auth configures how requests to the CoinDaemon are authenticated.
+	Auth *DaemonAuthConfig `json:"auth"`
+	// DaemonTimeout bounds every request to the CoinDaemon, as a duration
+	// such as "30s".
+	DaemonTimeout string `json:"daemontimeout"`
+	// DaemonRetries is how often failed idempotent requests are retried;
+	// DefaultDaemonRetries when unset.
+	DaemonRetries *int `json:"daemonretries"`
 }
 
-func readConfig() {
+func readConfig() *Config {
 	data, err := ioutil.ReadFile("./cfg.json")
 	if err != nil {
 		panic(err)
 	}
 
-	type ConfigJSON struct {
+	cfg := &Config{
+		CoinDaemon: DefaultCoinDaemonAddr,
 	}
-	var cfgJson ConfigJSON
-	err = json.Unmarshal(data, &cfgJson)
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
 		panic(err)
 	}
+	return cfg
+}
+
+// coinDaemon returns a client for the CoinDaemon the config points at.
+func (cfg *Config) coinDaemon() (*CoinDaemon, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		tlsConfig, err = cfg.TLS.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls in cfg.json: %v", err)
+		}
+	}
+	daemon, err := NewCoinDaemon(cfg.CoinDaemon, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DaemonTimeout != "" {
+		daemon.Timeout, err = time.ParseDuration(cfg.DaemonTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid daemontimeout in cfg.json: %v", err)
+		}
+	}
+	if cfg.Auth != nil {
+		if err := cfg.Auth.validate(); err != nil {
+			return nil, fmt.Errorf("invalid auth in cfg.json: %v", err)
+		}
+		if cfg.Auth.Type == "bearer" && daemon.BaseURL.Scheme != "https" && !isLoopback(daemon.BaseURL.Hostname()) {
+			log.Printf("Warning: sending the CoinDaemon token to %s unencrypted, use an https:// address or hmac auth", daemon.BaseURL.Host)
+		}
+		daemon.Auth = cfg.Auth
+	}
+	if cfg.DaemonRetries != nil {
+		if *cfg.DaemonRetries < 0 {
+			return nil, fmt.Errorf("invalid daemonretries in cfg.json: %d is negative", *cfg.DaemonRetries)
+		}
+		daemon.Retries = *cfg.DaemonRetries
+	}
+	return daemon, nil
 }
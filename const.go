@@ -5,9 +5,11 @@ const (
 	DefaultCoinDaemonAddr = "127.0.0.1:9000"
 )
 
+// Ledger app and CoinDaemon versions this CLI can sign with, checked by
+// checkCompatibility.
 var (
-	compatibleLedgerVersions = []int{}
-	compatibleDaemonVersions = []int{}
+	compatibleLedgerVersions = []versionRange{{Min: "0.5.0", Max: "0.6.0"}}
+	compatibleDaemonVersions = []versionRange{{Min: "0.5.0", Max: "0.6.0"}}
 )
 
 const (
@@ -19,6 +21,7 @@ const (
 	cmdGetOTAKey       = 0x06
 	cmdGetValidatorKey = 0x07
 	cmdKeyImage        = 0x10
+	cmdKeyImageBatch   = 0x11
 	// gen ring sig cmds set
 	cmdGenAlpha          = 0x21
 	cmdCalculateC        = 0x22
@@ -26,10 +29,12 @@ const (
 	cmdGenCoinPrivateKey = 0x24
 
 	cmdSignSchnorr = 0x40
+	cmdSignHash    = 0x41
 	cmdTrustHost   = 0x60
 
-	p1First = 0x00
-	p1More  = 0x80
+	p1First   = 0x00
+	p1More    = 0x80
+	p1Confirm = 0x01 // show the result on the device and wait for approval
 
 	p2DisplayAddress = 0x00
 	p2DisplayPubkey  = 0x01
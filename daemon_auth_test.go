@@ -0,0 +1,181 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testHMACSecret = "000102030405060708090a0b0c0d0e0f"
+
+func newAuth(t *testing.T, a DaemonAuthConfig) *DaemonAuthConfig {
+	t.Helper()
+	if err := a.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &a
+}
+
+// authDaemon serves a mock daemon requiring auth and returns it with a
+// client authenticating with clientAuth.
+func authDaemon(t *testing.T, auth, clientAuth *DaemonAuthConfig) (*CoinDaemon, *httptest.Server) {
+	t.Helper()
+	mock := NewMockDaemon()
+	mock.Auth = auth
+	daemon, srv := startMockDaemon(t, mock)
+	daemon.Auth = clientAuth
+	daemon.Retries = 0
+	return daemon, srv
+}
+
+// isUnauthorized reports whether err is the daemon refusing the request.
+func isUnauthorized(err error) bool {
+	var derr *DaemonError
+	return errors.As(err, &derr) && derr.StatusCode == http.StatusUnauthorized
+}
+
+// rawRequest sends a request with the given headers and returns its status.
+func rawRequest(t *testing.T, method, u string, h http.Header, body []byte) int {
+	t.Helper()
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDaemonAuthBearer(t *testing.T) {
+	auth := newAuth(t, DaemonAuthConfig{Type: "bearer", Token: "daemon token"})
+	ctx := context.Background()
+
+	daemon, srv := authDaemon(t, auth, auth)
+	defer srv.Close()
+	if _, err := daemon.Version(ctx); err != nil {
+		t.Fatal(err)
+	}
+	daemon.Auth = newAuth(t, DaemonAuthConfig{Type: "bearer", Token: "another token"})
+	if _, err := daemon.Version(ctx); !isUnauthorized(err) {
+		t.Fatalf("wrong token: got %v, want 401", err)
+	}
+	daemon.Auth = nil
+	if _, err := daemon.Version(ctx); !isUnauthorized(err) {
+		t.Fatalf("no token: got %v, want 401", err)
+	}
+}
+
+func TestDaemonAuthHMAC(t *testing.T) {
+	auth := newAuth(t, DaemonAuthConfig{Type: "hmac", KeyID: "cli", Secret: testHMACSecret})
+	daemon, srv := authDaemon(t, auth, auth)
+	defer srv.Close()
+	ctx := context.Background()
+
+	if _, err := daemon.Version(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a POST, whose body is signed too
+	err := daemon.ImportAccount(ctx, ImportAccountRequest{
+		AccountName:    "testacc",
+		PaymentAddress: "address",
+		OTAKey:         "ota key",
+		Viewkey:        "view key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.Auth = newAuth(t, DaemonAuthConfig{Type: "hmac", KeyID: "cli", Secret: "ff" + testHMACSecret[2:]})
+	if _, err := daemon.Version(ctx); !isUnauthorized(err) {
+		t.Fatalf("wrong secret: got %v, want 401", err)
+	}
+}
+
+func TestDaemonAuthHMACTamperedBody(t *testing.T) {
+	auth := newAuth(t, DaemonAuthConfig{Type: "hmac", KeyID: "cli", Secret: testHMACSecret})
+	_, srv := authDaemon(t, auth, auth)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/submitkeyimages")
+	body := []byte(`{"Account": "testacc"}`)
+	h := make(http.Header)
+	if err := auth.authorize(h, http.MethodPost, u, body); err != nil {
+		t.Fatal(err)
+	}
+	if code := rawRequest(t, http.MethodPost, u.String(), h, []byte(`{"Account": "otheracc"}`)); code != http.StatusUnauthorized {
+		t.Fatalf("tampered body: got %d, want 401", code)
+	}
+}
+
+func TestDaemonAuthHMACStale(t *testing.T) {
+	auth := newAuth(t, DaemonAuthConfig{Type: "hmac", KeyID: "cli", Secret: testHMACSecret})
+	_, srv := authDaemon(t, auth, auth)
+	defer srv.Close()
+
+	// a correctly signed request from an hour ago
+	u, _ := url.Parse(srv.URL + "/version")
+	timestamp := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	nonce := "00112233445566778899aabbccddeeff"
+	mac := hmac.New(sha256.New, auth.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", http.MethodGet, u.RequestURI(), timestamp, nonce, sha256.Sum256(nil))
+	h := make(http.Header)
+	h.Set(daemonTimestampHeader, timestamp)
+	h.Set(daemonNonceHeader, nonce)
+	h.Set("Authorization", "HMAC-SHA256 KeyId=cli, Signature="+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	if code := rawRequest(t, http.MethodGet, u.String(), h, nil); code != http.StatusUnauthorized {
+		t.Fatalf("stale timestamp: got %d, want 401", code)
+	}
+}
+
+func TestDaemonAuthHMACReplay(t *testing.T) {
+	auth := newAuth(t, DaemonAuthConfig{Type: "hmac", KeyID: "cli", Secret: testHMACSecret})
+	_, srv := authDaemon(t, auth, auth)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/version")
+	h := make(http.Header)
+	if err := auth.authorize(h, http.MethodGet, u, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code := rawRequest(t, http.MethodGet, u.String(), h, nil); code != http.StatusOK {
+		t.Fatalf("first request: got %d, want 200", code)
+	}
+	if code := rawRequest(t, http.MethodGet, u.String(), h, nil); code != http.StatusUnauthorized {
+		t.Fatalf("replayed nonce: got %d, want 401", code)
+	}
+}
+
+func TestDaemonAuthDialCreateTx(t *testing.T) {
+	auth := newAuth(t, DaemonAuthConfig{Type: "hmac", KeyID: "cli", Secret: testHMACSecret})
+	daemon, srv := authDaemon(t, auth, auth)
+	defer srv.Close()
+	ctx := context.Background()
+
+	c, err := daemon.DialCreateTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	daemon.Auth = nil
+	if _, err := daemon.DialCreateTx(ctx); !isUnauthorized(err) {
+		t.Fatalf("unauthenticated handshake: got %v, want 401", err)
+	}
+}
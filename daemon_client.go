@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultDaemonTimeout bounds a single request to the CoinDaemon.
+	DefaultDaemonTimeout = 30 * time.Second
+	// DefaultDaemonRetries is how often a failed idempotent request is
+	// retried.
+	DefaultDaemonRetries = 2
+
+	daemonRetryBackoff = 500 * time.Millisecond
+)
+
+// DaemonError is returned when the CoinDaemon answers a request with a
+// non-200 status.
+type DaemonError struct {
+	Endpoint   string
+	StatusCode int
+	// Message is the body of the response, which the daemon fills with a
+	// description of the problem.
+	Message string
+	// CloseCode is set instead of StatusCode when the daemon closed the
+	// /createtx websocket before the transaction was done; Message is the
+	// reason it gave.
+	CloseCode int
+}
+
+func (e *DaemonError) Error() string {
+	msg := fmt.Sprintf("CoinDaemon %s: %d %s", e.Endpoint, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.CloseCode != 0 {
+		msg = fmt.Sprintf("CoinDaemon %s: connection closed (%d)", e.Endpoint, e.CloseCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// temporary reports whether the request may succeed if retried.
+func (e *DaemonError) temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// CoinDaemon is a client for the CoinDaemon API, which tracks the coins of
+// imported accounts and builds transactions the device signs.
+type CoinDaemon struct {
+	// BaseURL is the http:// or https:// address the endpoints are
+	// relative to.
+	BaseURL *url.URL
+	// Timeout bounds every request, including retries; 0 means no limit.
+	// The createtx negotiation only uses it for the handshake.
+	Timeout time.Duration
+	// Retries is how often GET requests are retried after a network error
+	// or a temporary failure of the daemon.
+	Retries int
+	// Auth, if set, authenticates every request.
+	Auth *DaemonAuthConfig
+
+	client *http.Client
+	dialer *websocket.Dialer
+}
+
+// NewCoinDaemon returns a client for the daemon at addr, which is either
+// host:port or an http:// or https:// URL. tlsConfig is used for https and
+// may be nil for the system defaults.
+func NewCoinDaemon(addr string, tlsConfig *tls.Config) (*CoinDaemon, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CoinDaemon address: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid CoinDaemon address %q: unsupported scheme %q", addr, u.Scheme)
+	} else if u.Host == "" {
+		return nil, fmt.Errorf("invalid CoinDaemon address %q: missing host", addr)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &CoinDaemon{
+		BaseURL: u,
+		Timeout: DefaultDaemonTimeout,
+		Retries: DefaultDaemonRetries,
+		client:  &http.Client{Transport: transport},
+		dialer: &websocket.Dialer{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// endpoint returns the URL of the given endpoint, with query escaped.
+func (d *CoinDaemon) endpoint(path string, query url.Values) *url.URL {
+	u := *d.BaseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (d *CoinDaemon) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.Timeout)
+}
+
+// get fetches path and decodes the JSON response into out, retrying
+// network errors and temporary failures.
+func (d *CoinDaemon) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = d.do(ctx, http.MethodGet, path, query, nil, out)
+		if attempt == d.Retries || !retryable(ctx, err) {
+			return err
+		}
+		select {
+		case <-time.After(daemonRetryBackoff << uint(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// post sends in as JSON to path and decodes the response into out. It is
+// never retried, as the daemon may have acted on a request whose response
+// was lost.
+func (d *CoinDaemon) post(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	return d.do(ctx, http.MethodPost, path, nil, body, out)
+}
+
+func (d *CoinDaemon) do(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	u := d.endpoint(path, query)
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if d.Auth != nil {
+		if err := d.Auth.authorize(req.Header, method, u, body); err != nil {
+			return err
+		}
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("CoinDaemon %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("CoinDaemon %s: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &DaemonError{
+			Endpoint:   path,
+			StatusCode: resp.StatusCode,
+			Message:    string(bytes.TrimSpace(respBody)),
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("CoinDaemon %s: invalid response: %v", path, err)
+	}
+	return nil
+}
+
+// retryable reports whether a failed request is worth repeating.
+func retryable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var derr *DaemonError
+	if errors.As(err, &derr) {
+		return derr.temporary()
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+// Version returns the version the daemon reports.
+func (d *CoinDaemon) Version(ctx context.Context) (string, error) {
+	var result struct {
+		Version string
+	}
+	if err := d.get(ctx, "/version", nil, &result); err != nil {
+		return "", err
+	}
+	return result.Version, nil
+}
+
+// AccountList returns the payment address of every imported account, by
+// account name.
+func (d *CoinDaemon) AccountList(ctx context.Context) (map[string]string, error) {
+	result := make(map[string]string)
+	if err := d.get(ctx, "/getaccountlist", nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Balance returns the balance of the account for every token it holds.
+func (d *CoinDaemon) Balance(ctx context.Context, account string) (map[string]uint64, error) {
+	var result struct {
+		Address string
+		Balance map[string]uint64
+	}
+	if err := d.get(ctx, "/getbalance", url.Values{"account": {account}}, &result); err != nil {
+		return nil, err
+	}
+	return result.Balance, nil
+}
+
+// CoinsToDecrypt returns the coins of the account whose key images are not
+// known yet, as token ID -> coin public key -> encrypted km (hex).
+func (d *CoinDaemon) CoinsToDecrypt(ctx context.Context, account string) (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string)
+	if err := d.get(ctx, "/getcoinstodecrypt", url.Values{"account": {account}}, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// KeyImageSubmitResult is the daemon's answer to /submitkeyimages for one
+// token.
+type KeyImageSubmitResult struct {
+	// Accepted is the number of coins whose key images were stored.
+	Accepted int
+	// Rejected maps the public key of every refused coin to the reason.
+	Rejected map[string]string
+}
+
+// SubmitKeyImages stores the key images of coins of one token, given as
+// coin public key -> key image (hex).
+func (d *CoinDaemon) SubmitKeyImages(ctx context.Context, tokenID, account string, keyImages map[string]string) (*KeyImageSubmitResult, error) {
+	reqBody := struct {
+		Account   string
+		Keyimages map[string]map[string]string
+	}{
+		Account:   account,
+		Keyimages: map[string]map[string]string{tokenID: keyImages},
+	}
+	var result KeyImageSubmitResult
+	if err := d.post(ctx, "/submitkeyimages", reqBody, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ImportAccountRequest is what the daemon needs to scan the coins of an
+// account.
+type ImportAccountRequest struct {
+	AccountName    string
+	PaymentAddress string
+	OTAKey         string
+	Viewkey        string
+	BeaconHeight   uint64
+}
+
+// ImportAccount registers an account with the daemon.
+func (d *CoinDaemon) ImportAccount(ctx context.Context, req ImportAccountRequest) error {
+	if d.BaseURL.Scheme != "https" && !isLoopback(d.BaseURL.Hostname()) {
+		log.Printf("Warning: sending the view and OTA keys to %s unencrypted, use an https:// CoinDaemon address", d.BaseURL.Host)
+	}
+	return d.post(ctx, "/importaccount", req, nil)
+}
+
+// isLoopback reports whether host names this machine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// DialCreateTx opens the websocket over which the daemon drives the signing
+// of a transaction; see negotiateTx for the protocol.
+func (d *CoinDaemon) DialCreateTx(ctx context.Context) (*websocket.Conn, error) {
+	u := d.endpoint("/createtx", nil)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	header := make(http.Header)
+	if d.Auth != nil {
+		if err := d.Auth.authorize(header, http.MethodGet, u, nil); err != nil {
+			return nil, err
+		}
+	}
+	dialer := *d.dialer
+	dialer.HandshakeTimeout = d.Timeout
+	c, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &DaemonError{
+			Endpoint:   "/createtx",
+			StatusCode: resp.StatusCode,
+			Message:    string(bytes.TrimSpace(msg)),
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("CoinDaemon /createtx: %w", err)
+	}
+	return c, nil
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -15,191 +16,187 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func getDaemonVersion() (string, error) {
-	resp, err := http.Get("http://" + COINDAEMONADDR + "/getaccountlist")
-	if err != nil {
-		log.Fatalln(err)
-		return "", nil
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalln(err)
-		return "", nil
-	}
-	return string(body), nil
-}
+// submitEveryCoins is how many decrypted key images are collected before
+// they are submitted, so an interrupted refresh loses little work.
+const submitEveryCoins = 50
 
-func getAccountList() (map[string]string, error) {
-	result := make(map[string]string)
-	resp, err := http.Get("http://" + COINDAEMONADDR + "/getaccountlist")
+// requestImportAccount registers the account with the given index with the
+// daemon under accountName, and remembers which key it uses in
+// accounts.json.
+func requestImportAccount(ctx context.Context, nanos *NanoS, daemon *CoinDaemon, accountName string, index uint32, beaconHeight uint64) error {
+	viewKey, err := nanos.GetViewKey(index)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	otaKey, err := nanos.GetOTAKey(index)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	err = json.Unmarshal(body, &result)
+	addr, err := nanos.GetAddress(index)
 	if err != nil {
-		return nil, err
-	}
-	return result, nil
-}
-
-func submitKeyimages(tokenID string, account string, kms map[string]string) error {
-	var reqBody struct {
-		Account   string
-		Keyimages map[string]map[string]string
+		return err
 	}
-	reqKms := make(map[string]map[string]string)
-	for coinpub, km := range kms {
-		if _, ok := reqKms[tokenID]; !ok {
-			reqKms[tokenID] = make(map[string]string)
+	err = daemon.ImportAccount(ctx, ImportAccountRequest{
+		AccountName:    accountName,
+		PaymentAddress: addr,
+		OTAKey:         otaKey,
+		Viewkey:        viewKey,
+		BeaconHeight:   beaconHeight,
+	})
+	var derr *DaemonError
+	if errors.As(err, &derr) && derr.StatusCode == http.StatusConflict {
+		// already imported, e.g. before accounts.json existed; record
+		// the key if it is the same account
+		accounts, lerr := daemon.AccountList(ctx)
+		if lerr != nil {
+			return lerr
+		} else if accounts[accountName] != addr {
+			return fmt.Errorf("account %q already exists with another address than key %d: %v", accountName, index, err)
 		}
-		reqKms[tokenID][coinpub] = km
-	}
-	reqBody.Account = account
-	reqBody.Keyimages = reqKms
-
-	reqBytes, _ := json.Marshal(reqBody)
-	req, err := http.NewRequest("POST", "http://"+COINDAEMONADDR+"/submitkeyimages", bytes.NewBuffer(reqBytes))
-	if err != nil {
-		panic(err)
+		log.Printf("Account %q is already imported, recording that it uses key %d", accountName, index)
+	} else if err != nil {
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-	fmt.Println("response Status:", resp.Status)
-	fmt.Println("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	fmt.Println("response Body:", string(body))
-	return nil
-}
-
-func getEncryptKeyImages(accountName string) (map[string]map[string]string, error) {
-	result := make(map[string]map[string]string)
-	resp, err := http.Get("http://" + COINDAEMONADDR + "/getcoinstodecrypt?account=" + accountName)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	fmt.Println(resp.StatusCode)
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	err = json.Unmarshal(body, &result)
+	state, err := loadAccountState()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return result, nil
+	state.Accounts[accountName] = accountRecord{Index: index, Address: addr}
+	return state.save()
 }
 
-func getAccountBalance(accountName string) (map[string]uint64, error) {
-	var result struct {
-		Address string
-		Balance map[string]uint64
-	}
-	resp, err := http.Get("http://" + COINDAEMONADDR + "/getbalance?account=" + accountName)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return nil, err
-	}
-	return result.Balance, nil
-}
-
-func requestUpdateBalance(account string) (int, error) {
-	nanos, err := OpenNanoS()
-	if err != nil {
-		log.Println("This cmd require connected to ledger device")
-		log.Fatalln("Couldn't open device:", err)
-	}
+func requestUpdateBalance(ctx context.Context, nanos *NanoS, daemon *CoinDaemon, account string) (int, error) {
 	var coinUpdated int
 	fmt.Println("getting coin to decrypt...")
-	keyimages, err := getEncryptKeyImages(account)
+	keyimages, err := daemon.CoinsToDecrypt(ctx, account)
 	if err != nil {
 		return 0, err
 	}
-	fmt.Println(keyimages)
 
-	err = nanos.TrustHost()
+	// reuse the key images an earlier, interrupted run decrypted
+	checkpoint, err := loadCheckpoint(account)
 	if err != nil {
 		return 0, err
 	}
-	decryptedKeyimages := make(map[string]map[string]string)
-	tokenIDs := []string{}
+	checkpoint.prune(keyimages)
+	pending := make(map[string][]KeyImageRequest)
+	total, resumed := 0, 0
 	for tokenID, coinList := range keyimages {
-		tokenIDs = append(tokenIDs, tokenID)
-		decryptedKeyimages[tokenID] = make(map[string]string)
 		for coinPk, km := range coinList {
-			dekm, err := nanos.GenKeyImage(coinPk, km)
-			if err != nil {
-				panic(err)
+			if _, ok := checkpoint.keyImage(tokenID, coinPk); ok {
+				resumed++
+				continue
 			}
-			decryptedKeyimages[tokenID][coinPk] = dekm
-			fmt.Println("decryptedKeyimages[coinPk]", coinPk, dekm)
+			pending[tokenID] = append(pending[tokenID], KeyImageRequest{CoinPubkey: coinPk, EncryptKm: km})
+			total++
 		}
 	}
+	if resumed > 0 {
+		fmt.Printf("resuming: %d coins were already decrypted\n", resumed)
+	}
+	if total+resumed == 0 {
+		return coinUpdated, checkpoint.finish()
+	}
 
-	for _, tokenID := range tokenIDs {
-		e := submitKeyimages(tokenID, "testacc", decryptedKeyimages[tokenID])
+	if total > 0 {
+		err = nanos.TrustHost()
 		if err != nil {
-			panic(e)
+			return 0, err
+		}
+		if err := useAccountKey(nanos, account); err != nil {
+			return 0, err
 		}
 	}
-
-	return coinUpdated, nil
-}
-
-func importAccount(name, addr, otaKey, viewKey string, beaconHeight uint64) error {
-	type API_import_account_req struct {
-		AccountName    string
-		PaymentAddress string
-		OTAKey         string
-		Viewkey        string
-		BeaconHeight   uint64
+	tokens := make(map[string]bool)
+	for tokenID := range pending {
+		tokens[tokenID] = true
 	}
-
-	reqdata := API_import_account_req{
-		AccountName:    name,
-		OTAKey:         otaKey,
-		Viewkey:        viewKey,
-		PaymentAddress: addr,
-		BeaconHeight:   beaconHeight,
+	for tokenID := range checkpoint.Decrypted {
+		tokens[tokenID] = true
 	}
-	reqBytes, err := json.Marshal(reqdata)
-	if err != nil {
-		panic(err)
+	bar := newProgressBar(os.Stderr, "decrypting", total)
+	var summaries []string
+	for tokenID := range tokens {
+		var tokenAccepted, tokenRejected, unsubmitted int
+		submit := func() error {
+			sent := checkpoint.unconfirmed(tokenID)
+			if len(sent) == 0 {
+				return nil
+			}
+			unsubmitted = 0
+			result, err := daemon.SubmitKeyImages(ctx, tokenID, account, sent)
+			if err != nil {
+				return err
+			}
+			if !checkpoint.confirm(tokenID, sent, result) {
+				log.Printf("CoinDaemon accounted for %d of %d key images of token %s, keeping them to submit again", result.Accepted+len(result.Rejected), len(sent), tokenID)
+			}
+			coinUpdated += result.Accepted
+			tokenRejected += len(result.Rejected)
+			tokenAccepted += result.Accepted
+			return checkpoint.save()
+		}
+		coins := pending[tokenID]
+		for len(coins) > 0 {
+			batch := coins
+			if len(batch) > keyImageBatchSize {
+				batch = batch[:keyImageBatchSize]
+			}
+			coins = coins[len(batch):]
+			kis, err := genKeyImagesReconnecting(nanos, batch)
+			if err != nil {
+				bar.Finish()
+				// the checkpoint keeps what was decrypted so far
+				if serr := submit(); serr != nil {
+					log.Println("Couldn't submit key images:", serr)
+				}
+				return coinUpdated, err
+			}
+			for i, coin := range batch {
+				checkpoint.add(tokenID, coin.CoinPubkey, kis[i])
+			}
+			if err := checkpoint.save(); err != nil {
+				bar.Finish()
+				return coinUpdated, err
+			}
+			bar.Add(len(batch))
+			unsubmitted += len(batch)
+			if unsubmitted >= submitEveryCoins {
+				if err := submit(); err != nil {
+					bar.Finish()
+					return coinUpdated, err
+				}
+			}
+		}
+		if err := submit(); err != nil {
+			bar.Finish()
+			return coinUpdated, err
+		}
+		summaries = append(summaries, fmt.Sprintf("token %s: %d coins accepted, %d rejected", tokenID, tokenAccepted, tokenRejected))
 	}
-	fmt.Println("reqBytes", string(reqBytes))
-	req, err := http.NewRequest("POST", "http://"+COINDAEMONADDR+"/importaccount", bytes.NewBuffer(reqBytes))
-	if err != nil {
-		panic(err)
+	bar.Finish()
+	for _, summary := range summaries {
+		fmt.Println(summary)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
+	return coinUpdated, checkpoint.finish()
+}
+
+// genKeyImagesReconnecting is GenKeyImages, waiting for the device and
+// retrying once if it is lost. Key images don't depend on each other, so
+// nothing has to be redone but the failed batch.
+func genKeyImagesReconnecting(nanos *NanoS, batch []KeyImageRequest) ([]string, error) {
+	kis, err := nanos.GenKeyImages(batch)
+	if !IsDeviceLost(err) {
+		return kis, err
+	}
+	log.Println("Lost the device:", err)
+	ctx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+	defer cancel()
+	if err := nanos.Reconnect(ctx); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-	fmt.Println("response Status:", resp.Status)
-	fmt.Println("response Headers:", resp.Header)
-	body, err := ioutil.ReadAll(resp.Body)
-	fmt.Println("response Body:", string(body))
-	return err
+	return nanos.GenKeyImages(batch)
 }
 
 type LedgerRequest struct {
@@ -207,147 +204,210 @@ type LedgerRequest struct {
 	Data []byte
 }
 
-func requestCreateTx(txjsonFile string) (string, error) {
-	var txID string
+// maxCreateTxRestarts bounds how often a transaction is started over after
+// the device was lost in the middle of signing it.
+const maxCreateTxRestarts = 3
+
+func requestCreateTx(ctx context.Context, nanos *NanoS, daemon *CoinDaemon, txjsonFile string) (string, error) {
 	data, err := ioutil.ReadFile(txjsonFile)
 	if err != nil {
-		panic(err)
+		return "", err
+	}
+	var txInfo struct {
+		Account string `json:"account"`
+	}
+	if err := json.Unmarshal(data, &txInfo); err != nil {
+		return "", err
+	}
+	if err := useAccountKey(nanos, txInfo.Account); err != nil {
+		return "", err
+	}
+	for restarts := 0; ; restarts++ {
+		txID, err := negotiateTx(ctx, nanos, daemon, data)
+		if !IsDeviceLost(err) || restarts == maxCreateTxRestarts {
+			return txID, err
+		}
+		// the ring signature state lived on the device and is gone, so
+		// once it is back the daemon has to start the transaction over
+		log.Println("Lost the device while signing:", err)
+		reconnectCtx, cancel := context.WithTimeout(ctx, reconnectTimeout)
+		err = nanos.Reconnect(reconnectCtx)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		log.Println("Restarting transaction")
 	}
-	c, _, err := websocket.DefaultDialer.Dial("ws://"+COINDAEMONADDR+"/createtx", nil)
+}
+
+func negotiateTx(ctx context.Context, nanos *NanoS, daemon *CoinDaemon, data []byte) (string, error) {
+	c, err := daemon.DialCreateTx(ctx)
 	if err != nil {
-		log.Fatal("dial:", err)
+		return "", err
 	}
 	defer c.Close()
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
 
 	sendMsgCh := make(chan []byte)
 	done := make(chan struct{})
-	var nanos *NanoS
-
-	nanos, err = OpenNanoS()
-	if err != nil {
-		log.Println("This cmd require connected to ledger device")
-		log.Fatalln("Couldn't open device:", err)
+	// stop tells the reader goroutine the loop below has returned; closing
+	// c as well unblocks its reads, so it always releases the device
+	stop := make(chan struct{})
+	defer close(stop)
+	// deviceErr and txID are set by the reader goroutine before it closes
+	// done
+	var deviceErr error
+	var txID string
+	send := func(msg []byte) bool {
+		select {
+		case sendMsgCh <- msg:
+			return true
+		case <-stop:
+			return false
+		}
 	}
 
 	go func() {
-		fmt.Println("sendMsgCh <- data", data)
-		sendMsgCh <- data
 		defer close(done)
-		for {
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				log.Println("read:", err)
-				return
-			}
-			var req LedgerRequest
-			err = json.Unmarshal(message, &req)
-			if err != nil {
-				log.Println("read:", err)
-				return
-			}
-			switch req.Cmd {
-			case "signschnorr":
-				type ReqStruct struct {
-					PedRandom  []byte
-					PedPrivate []byte
-					Randomness []byte
-					Message    []byte
-				}
-				requestData := ReqStruct{}
-				err := json.Unmarshal(req.Data, &requestData)
-				if err != nil {
-					panic(err)
-				}
-				sig, err := nanos.SignSchnorr(requestData.PedRandom, requestData.PedPrivate, requestData.Randomness, requestData.Message)
-				if err != nil {
-					panic(err)
-				}
-				sendMsgCh <- sig
-			case "genalpha":
-				type ReqStruct struct {
-					AlphaLength int
-				}
-				requestData := ReqStruct{}
-				err := json.Unmarshal(req.Data, &requestData)
-				if err != nil {
-					panic(err)
-				}
-				fmt.Println("genalpha with AlphaLength", requestData.AlphaLength)
-				err = nanos.GenerateAlpha(requestData.AlphaLength)
-				if err != nil {
-					panic(err)
-				}
-				sendMsgCh <- []byte("success")
-			case "gencoinprivate":
-				type ReqStruct struct {
-					CoinsH [][]byte
-				}
-				requestData := ReqStruct{}
-				err := json.Unmarshal(req.Data, &requestData)
-				if err != nil {
-					panic(err)
-				}
-				fmt.Println("gencoinprivate with CoinsH", len(requestData.CoinsH))
-				err = nanos.GenCoinPrivateKey(requestData.CoinsH)
-				if err != nil {
-					panic(err)
-				}
-				sendMsgCh <- []byte("success")
-			case "calculatec": // calculate 1st C
-				type ReqStruct struct {
-					Rpi     [][]byte
-					PedComG []byte
-				}
-				requestData := ReqStruct{}
-				err := json.Unmarshal(req.Data, &requestData)
-				if err != nil {
-					panic(err)
-				}
-				firstC, err := nanos.CalculateFirstC(requestData.Rpi, requestData.PedComG)
-				if err != nil {
-					panic(err)
-				}
-				sendMsgCh <- firstC
-			case "calculater": // calculate r
-				type ReqStruct struct {
-					CoinLength int
-					Cpi        []byte
-				}
-				requestData := ReqStruct{}
-				err := json.Unmarshal(req.Data, &requestData)
+		fmt.Println("sendMsgCh <- data", data)
+		if !send(data) {
+			return
+		}
+		// hold the device for the whole negotiation so no other user of
+		// nanos can slip commands in between the ring signature steps
+		deviceErr = nanos.Session(WithPriority(ctx, PriorityHigh), func(dev *NanoS) error {
+			for {
+				_, message, err := c.ReadMessage()
 				if err != nil {
-					panic(err)
+					return createTxReadError(err)
 				}
-				new_rPi, err := nanos.CalculateR(requestData.CoinLength, requestData.Cpi)
+				var req LedgerRequest
+				err = json.Unmarshal(message, &req)
 				if err != nil {
-					panic(err)
+					return fmt.Errorf("CoinDaemon /createtx: invalid request: %v", err)
 				}
-				rPiBytes, err := json.Marshal(new_rPi)
-				if err != nil {
-					panic(err)
+				switch req.Cmd {
+				case "signschnorr":
+					type ReqStruct struct {
+						PedRandom  []byte
+						PedPrivate []byte
+						Randomness []byte
+						Message    []byte
+					}
+					requestData := ReqStruct{}
+					err := json.Unmarshal(req.Data, &requestData)
+					if err != nil {
+						return fmt.Errorf("invalid %s request: %v", req.Cmd, err)
+					}
+					sig, err := dev.SignSchnorr(requestData.PedRandom, requestData.PedPrivate, requestData.Randomness, requestData.Message)
+					if err != nil {
+						return err
+					}
+					if !send(sig) {
+						return nil
+					}
+				case "genalpha":
+					type ReqStruct struct {
+						AlphaLength int
+					}
+					requestData := ReqStruct{}
+					err := json.Unmarshal(req.Data, &requestData)
+					if err != nil {
+						return fmt.Errorf("invalid %s request: %v", req.Cmd, err)
+					}
+					fmt.Println("genalpha with AlphaLength", requestData.AlphaLength)
+					err = dev.GenerateAlpha(requestData.AlphaLength)
+					if err != nil {
+						return err
+					}
+					if !send([]byte("success")) {
+						return nil
+					}
+				case "gencoinprivate":
+					type ReqStruct struct {
+						CoinsH [][]byte
+					}
+					requestData := ReqStruct{}
+					err := json.Unmarshal(req.Data, &requestData)
+					if err != nil {
+						return fmt.Errorf("invalid %s request: %v", req.Cmd, err)
+					}
+					fmt.Println("gencoinprivate with CoinsH", len(requestData.CoinsH))
+					err = dev.GenCoinPrivateKey(requestData.CoinsH)
+					if err != nil {
+						return err
+					}
+					if !send([]byte("success")) {
+						return nil
+					}
+				case "calculatec": // calculate 1st C
+					type ReqStruct struct {
+						Rpi     [][]byte
+						PedComG []byte
+					}
+					requestData := ReqStruct{}
+					err := json.Unmarshal(req.Data, &requestData)
+					if err != nil {
+						return fmt.Errorf("invalid %s request: %v", req.Cmd, err)
+					}
+					firstC, err := dev.CalculateFirstC(requestData.Rpi, requestData.PedComG)
+					if err != nil {
+						return err
+					}
+					if !send(firstC) {
+						return nil
+					}
+				case "calculater": // calculate r
+					type ReqStruct struct {
+						CoinLength int
+						Cpi        []byte
+					}
+					requestData := ReqStruct{}
+					err := json.Unmarshal(req.Data, &requestData)
+					if err != nil {
+						return fmt.Errorf("invalid %s request: %v", req.Cmd, err)
+					}
+					new_rPi, err := dev.CalculateR(requestData.CoinLength, requestData.Cpi)
+					if err != nil {
+						return err
+					}
+					rPiBytes, err := json.Marshal(new_rPi)
+					if err != nil {
+						return err
+					}
+					if !send(rPiBytes) {
+						return nil
+					}
+				case "result":
+					fmt.Println(string(req.Data), hex.EncodeToString(req.Data))
+					txID = string(req.Data)
+					return nil
+				default:
+					log.Println("unknown command")
 				}
-				sendMsgCh <- rPiBytes
-			case "result":
-				fmt.Println(string(req.Data), hex.EncodeToString(req.Data))
-				return
-			default:
-				log.Println("unknown command")
 			}
-		}
+		})
 	}()
 	for {
 		select {
 		case <-done:
-			return txID, nil
+			if deviceErr != nil && !isCloseError(deviceErr) {
+				// let the daemon drop its half of the negotiation
+				c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "signing failed"))
+			}
+			return txID, deviceErr
 		case msg := <-sendMsgCh:
 			err := c.WriteMessage(websocket.TextMessage, msg)
 			if err != nil {
 				log.Println("write:", err)
-				return txID, err
+				return "", err
 			}
+		case <-ctx.Done():
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "cancelled"))
+			return "", ctx.Err()
 		case <-interrupt:
 			log.Println("interrupt")
 
@@ -356,13 +416,38 @@ func requestCreateTx(txjsonFile string) (string, error) {
 			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
 				log.Println("write close:", err)
-				return txID, err
+				return "", err
 			}
 			select {
 			case <-done:
+				if txID != "" {
+					return txID, nil
+				}
 			case <-time.After(time.Second):
 			}
-			return txID, nil
+			return "", errors.New("interrupted")
 		}
 	}
 }
+
+// createTxReadError turns the failure to read the daemon's next request
+// into the reason the negotiation ended: a DaemonError if the daemon
+// closed the websocket, or the I/O error.
+func createTxReadError(err error) error {
+	var cerr *websocket.CloseError
+	if errors.As(err, &cerr) {
+		return &DaemonError{
+			Endpoint:  "/createtx",
+			CloseCode: cerr.Code,
+			Message:   cerr.Text,
+		}
+	}
+	return fmt.Errorf("CoinDaemon /createtx: %w", err)
+}
+
+// isCloseError reports whether err means the daemon closed the negotiation,
+// so there is no half of it to drop.
+func isCloseError(err error) bool {
+	var derr *DaemonError
+	return errors.As(err, &derr) && derr.CloseCode != 0
+}
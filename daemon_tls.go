@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// DaemonTLSConfig is the "tls" section of cfg.json, used for https://
+// CoinDaemon addresses.
+type DaemonTLSConfig struct {
+	// CA is a PEM bundle of the certificates the daemon's certificate must
+	// chain to, instead of the system roots.
+	CA string `json:"ca"`
+	// Cert and Key are PEM files of a client certificate, for daemons that
+	// require one.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ServerName overrides the host name the daemon's certificate is
+	// checked against.
+	ServerName string `json:"servername"`
+	// Pins, if set, are "sha256/<base64>" hashes of public keys, one of
+	// which must appear in the verified certificate chain.
+	Pins []string `json:"pins"`
+}
+
+// tlsConfig builds the client TLS configuration c describes.
+func (c *DaemonTLSConfig) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, errors.New("a client certificate needs both cert and key")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.Pins) > 0 {
+		pins := make(map[[sha256.Size]byte]bool)
+		for _, pin := range c.Pins {
+			hash, err := parsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins[hash] = true
+		}
+		cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("CoinDaemon certificate does not match any pinned key")
+		}
+	}
+	return cfg, nil
+}
+
+// parsePin decodes a "sha256/<base64>" public key pin, the format printed
+// by e.g. `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der |
+// openssl dgst -sha256 -binary | base64`.
+func parsePin(pin string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	b64 := strings.TrimPrefix(pin, "sha256/")
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(raw) != sha256.Size {
+		return hash, fmt.Errorf("invalid pin %q: want sha256/<base64 SHA-256 of the public key>", pin)
+	}
+	copy(hash[:], raw)
+	return hash, nil
+}
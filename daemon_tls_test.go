@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// tlsTestHandler answers /version and upgrades /createtx, which is all the
+// TLS tests need of a daemon.
+func tlsTestHandler() http.Handler {
+	var upgrader websocket.Upgrader
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Version": "test"}`))
+	})
+	mux.HandleFunc("/createtx", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.ReadMessage()
+		c.Close()
+	})
+	return mux
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsDaemon returns a client for srv configured by c, without retries so
+// failing handshakes fail fast.
+func tlsDaemon(t *testing.T, srv *httptest.Server, c *DaemonTLSConfig) *CoinDaemon {
+	t.Helper()
+	var tlsConfig *tls.Config
+	if c != nil {
+		var err error
+		tlsConfig, err = c.tlsConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	daemon, err := NewCoinDaemon(srv.URL, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.Retries = 0
+	return daemon
+}
+
+// serverPin is the pin of the public key of srv's certificate.
+func serverPin(srv *httptest.Server) string {
+	hash := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestDaemonTLSCA(t *testing.T) {
+	defer inTempDir(t)()
+	srv := httptest.NewTLSServer(tlsTestHandler())
+	defer srv.Close()
+	writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	ctx := context.Background()
+
+	// the test certificate is not signed by any system root
+	if _, err := tlsDaemon(t, srv, nil).Version(ctx); err == nil {
+		t.Fatal("certificate accepted by the system roots")
+	}
+	if _, err := tlsDaemon(t, srv, &DaemonTLSConfig{CA: "ca.pem"}).Version(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemonTLSPins(t *testing.T) {
+	defer inTempDir(t)()
+	srv := httptest.NewTLSServer(tlsTestHandler())
+	defer srv.Close()
+	writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	ctx := context.Background()
+
+	pinned := &DaemonTLSConfig{CA: "ca.pem", Pins: []string{serverPin(srv)}}
+	if _, err := tlsDaemon(t, srv, pinned).Version(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wrong := sha256.Sum256([]byte("another key"))
+	mispinned := &DaemonTLSConfig{CA: "ca.pem", Pins: []string{"sha256/" + base64.StdEncoding.EncodeToString(wrong[:])}}
+	if _, err := tlsDaemon(t, srv, mispinned).Version(ctx); err == nil {
+		t.Fatal("certificate accepted with a wrong pin")
+	}
+}
+
+func TestDaemonTLSClientCert(t *testing.T) {
+	defer inTempDir(t)()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "incognitoledger test client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, "client.pem", "CERTIFICATE", der)
+	writePEM(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+
+	srv := httptest.NewUnstartedServer(tlsTestHandler())
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  x509.NewCertPool(),
+	}
+	srv.TLS.ClientCAs.AddCert(cert)
+	srv.StartTLS()
+	defer srv.Close()
+	writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	ctx := context.Background()
+
+	if _, err := tlsDaemon(t, srv, &DaemonTLSConfig{CA: "ca.pem"}).Version(ctx); err == nil {
+		t.Fatal("daemon accepted a client without a certificate")
+	}
+	withCert := &DaemonTLSConfig{CA: "ca.pem", Cert: "client.pem", Key: "client-key.pem"}
+	if _, err := tlsDaemon(t, srv, withCert).Version(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemonTLSDialCreateTx(t *testing.T) {
+	defer inTempDir(t)()
+	srv := httptest.NewTLSServer(tlsTestHandler())
+	defer srv.Close()
+	writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	ctx := context.Background()
+
+	pinned := &DaemonTLSConfig{CA: "ca.pem", Pins: []string{serverPin(srv)}}
+	c, err := tlsDaemon(t, srv, pinned).DialCreateTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := tlsDaemon(t, srv, nil).DialCreateTx(ctx); err == nil {
+		t.Fatal("wss handshake succeeded against an untrusted certificate")
+	}
+}
@@ -0,0 +1,232 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0xkumi/incognito-dev-framework/account"
+	"github.com/incognitochain/incognito-chain/common"
+	"github.com/incognitochain/incognito-chain/privacy"
+	"github.com/incognitochain/incognito-chain/privacy/operation"
+	"lukechampine.com/flagg"
+)
+
+const (
+	devUsage = `Usage:
+	incognitoledger dev [action]
+
+Developer commands. They print secret keys or rely on embedded test keys,
+and are only present in builds made with -tags dev.
+
+Actions:
+    priv            print the private key with the specified index
+    genkeyimage     compute the key image of a test coin
+    signschnorr     sign and verify a test message
+    benchmark       measure APDU latency
+    mockdaemon      serve an in-memory CoinDaemon
+`
+	privUsage = `Usage:
+	incognitoledger dev priv [-index n | key index]
+
+Prints the private key with the specified index (default 0).
+`
+	genKeyImageUsage = `Usage:
+	incognitoledger dev genkeyimage
+
+Computes the key image of a fixed test coin.
+`
+	signSchnorrUsage = `Usage:
+	incognitoledger dev signschnorr
+
+Signs a test message and verifies the signature against the embedded test
+account.
+`
+	benchmarkUsage = `Usage:
+	incognitoledger dev benchmark [flags]
+
+Measures the latency of every APDU the app supports and reports min,
+median, p95 and max per command and, over HID, per packet. Commands that
+need approval on the device (SignHash) only run with -interactive or when
+named in -cmds.
+`
+	mockDaemonUsage = `Usage:
+	incognitoledger dev mockdaemon [-addr host:port] [-coins n]
+
+Serves an in-memory CoinDaemon (see MockDaemon) for trying importacc,
+getbalance, updatebalance and createtx with --device emu. Imported
+accounts get n random PRV coins. Requests must carry the auth configured
+in cfg.json, if any.
+`
+)
+
+// emulatorKeyEnv names the environment variable holding the private key used
+// by "--device emu".
+const emulatorKeyEnv = "INCOGNITO_EMULATOR_KEY"
+
+// OpenEmulator returns a NanoS backed by an emulator holding the private key
+// from $INCOGNITO_EMULATOR_KEY.
+func OpenEmulator() (*NanoS, error) {
+	key := os.Getenv(emulatorKeyEnv)
+	if key == "" {
+		return nil, errors.New(emulatorKeyEnv + " is not set")
+	}
+	emu, err := NewEmulator(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewNanoS(emu), nil
+}
+
+// Private key of the test account signschnorr verifies against.
+const devTestPrivateKey = "111111bgk2j6vZQvzq8tkonDLLXEvLkMwBMn5BoLXLpf631boJnPDGEQMGvA1pRfT71Crr7MM2ShvpkxCBWBL2icG22cXSpcKybKCQmaxa"
+
+func init() {
+	openEmulator = OpenEmulator
+
+	devCmd := flagg.New("dev", devUsage)
+	privCmd := flagg.New("priv", privUsage)
+	privIndex := indexFlag(privCmd)
+	genKeyImageCmd := flagg.New("genkeyimage", genKeyImageUsage)
+	signSchnorrCmd := flagg.New("signschnorr", signSchnorrUsage)
+	benchmarkCmd := flagg.New("benchmark", benchmarkUsage)
+	benchIterations := benchmarkCmd.Int("n", 20, "timed iterations per command")
+	benchWarmup := benchmarkCmd.Int("warmup", 3, "untimed iterations before measuring")
+	benchSizes := benchmarkCmd.String("sizes", "1,4,7", "comma-separated KeyImageBatch sizes")
+	benchCmds := benchmarkCmd.String("cmds", "", "comma-separated commands to run (default all)")
+	benchInteractive := benchmarkCmd.Bool("interactive", false, "include commands that need approval on the device")
+	benchJSON := benchmarkCmd.Bool("json", false, "write the report as JSON")
+	mockDaemonCmd := flagg.New("mockdaemon", mockDaemonUsage)
+	mockAddr := mockDaemonCmd.String("addr", DefaultCoinDaemonAddr, "address to listen on")
+	mockCoins := mockDaemonCmd.Int("coins", 5, "coins given to every imported account")
+
+	devTree = flagg.Tree{
+		Cmd: devCmd,
+		Sub: []flagg.Tree{
+			{Cmd: privCmd},
+			{Cmd: genKeyImageCmd},
+			{Cmd: signSchnorrCmd},
+			{Cmd: benchmarkCmd},
+			{Cmd: mockDaemonCmd},
+		},
+	}
+	devOffline = []*flag.FlagSet{devCmd, mockDaemonCmd}
+
+	runDevCommand = func(cmd *flag.FlagSet, nanos *NanoS, args []string) {
+		switch cmd {
+		case devCmd:
+			devCmd.Usage()
+		case privCmd:
+			index, ok := accountIndex(privCmd, privIndex, args)
+			if !ok {
+				privCmd.Usage()
+				return
+			}
+			priv, err := nanos.GetPrivateKey(index)
+			if err != nil {
+				log.Fatalln("Couldn't get private key:", err)
+			}
+			fmt.Println(priv)
+		case genKeyImageCmd:
+			err := nanos.TrustHost()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			result, err := nanos.GenKeyImage(benchCoinPubkey, benchEncryptKm)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Println("keyimage:", result)
+		case signSchnorrCmd:
+			devSignSchnorr(nanos)
+		case benchmarkCmd:
+			sizes, err := parseSizes(*benchSizes)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			cfg := benchConfig{
+				Iterations:  *benchIterations,
+				Warmup:      *benchWarmup,
+				BatchSizes:  sizes,
+				Interactive: *benchInteractive,
+			}
+			if *benchCmds != "" {
+				cfg.Commands = strings.Split(*benchCmds, ",")
+			}
+			report := runBenchmark(nanos, cfg)
+			if *benchJSON {
+				err = report.writeJSON(os.Stdout)
+			} else {
+				err = report.writeTable(os.Stdout)
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+		case mockDaemonCmd:
+			mock := NewMockDaemon()
+			mock.CoinsPerImport = *mockCoins
+			if cfg := readConfig(); cfg.Auth != nil {
+				if err := cfg.Auth.validate(); err != nil {
+					log.Fatalln("invalid auth in cfg.json:", err)
+				}
+				mock.Auth = cfg.Auth
+			}
+			log.Println("mock CoinDaemon listening on", *mockAddr)
+			log.Fatalln(http.ListenAndServe(*mockAddr, mock))
+		}
+	}
+}
+
+func (n *NanoS) GetPrivateKey(index uint32) (priv string, err error) {
+	resp, err := n.Exchange(cmdGetPrivateKey, 0, 0, encodeIndex(index))
+	if err != nil {
+		return
+	}
+	priv = string(resp)
+	return
+}
+
+// devSignSchnorr signs a test message with the device and verifies the
+// signature against devTestPrivateKey, which must be the key on the device.
+func devSignSchnorr(nanos *NanoS) {
+	acc0, err := account.NewAccountFromPrivatekey(devTestPrivateKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t := time.Now()
+	r := new(privacy.Scalar).FromUint64(1)
+	pedRandom := operation.PedCom.G[operation.PedersenRandomnessIndex].GetKey()
+	pedPrivate := operation.PedCom.G[operation.PedersenPrivateKeyIndex].GetKey()
+	message := "testasfdgtestasfdgfgfdgfgtestasfdgfgfdgtestasfdgfgfdgtestasfdgfgfdgfdg"
+	hash := common.HashH([]byte(message))
+	resp, err := nanos.SignSchnorr(pedRandom[:], pedPrivate[:], r.ToBytesS(), hash.Bytes())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("resp", resp, len(resp))
+	fmt.Println("signSchnorr:", time.Since(t))
+
+	//verify
+	verifyKey := new(privacy.SchnorrPublicKey)
+	metaSigPublicKey, err := new(privacy.Point).FromBytesS(acc0.Keyset.PaymentAddress.Pk)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	metaSigPublicKey.Add(metaSigPublicKey, new(operation.Point).ScalarMult(operation.PedCom.G[operation.PedersenRandomnessIndex], r))
+	verifyKey.Set(metaSigPublicKey)
+
+	signature := new(privacy.SchnSignature)
+	if err := signature.SetBytes(resp); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("verify sig", verifyKey.Verify(signature, hash.Bytes()))
+}
@@ -0,0 +1,343 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/0xkumi/incognito-dev-framework/account"
+	"github.com/incognitochain/incognito-chain/common"
+	"github.com/incognitochain/incognito-chain/incognitokey"
+	"github.com/incognitochain/incognito-chain/privacy"
+	"github.com/incognitochain/incognito-chain/privacy/operation"
+	"github.com/incognitochain/incognito-chain/wallet"
+)
+
+// emulatorVersion is the app version reported by the emulator.
+var emulatorVersion = [3]byte{0, 5, 5}
+
+// Emulator is a software stand-in for the Incognito Ledger app. It answers
+// every APDU in const.go from a private key held in memory, so the whole
+// importacc -> updatebalance -> createtx flow can run without a device.
+type Emulator struct {
+	// keys holds the key set of every account index used so far; index 0
+	// is the key the emulator was created with.
+	keys map[uint32]*incognitokey.KeySet
+	// active is the account signing commands act for.
+	active uint32
+
+	// Reject makes the emulator refuse every request that needs the user
+	// to confirm something on screen, as if they had pressed reject.
+	Reject bool
+
+	// ring signature state, mirroring what the app keeps between APDUs
+	alphas   []*privacy.Scalar
+	coinKeys []*privacy.Scalar
+
+	// partially received chunked payload
+	pending    []byte
+	pendingINS byte
+}
+
+// emulatorPayloadLen holds the payload length of commands that take a fixed
+// amount of data, used to tell when a chunked payload is complete.
+var emulatorPayloadLen = map[byte]int{
+	cmdKeyImage:          64,
+	cmdCalculateC:        32,
+	cmdCalculateR:        32,
+	cmdGenCoinPrivateKey: 32,
+	cmdSignSchnorr:       128,
+	cmdSignHash:          36,
+}
+
+// expectedPayloadLen returns the full payload length of a command, or 0 if
+// it does not have a fixed one.
+func expectedPayloadLen(ins, p2 byte) int {
+	if ins == cmdKeyImageBatch {
+		return 64 * int(p2)
+	}
+	return emulatorPayloadLen[ins]
+}
+
+// NewEmulator returns an emulator holding the given base58 private key.
+func NewEmulator(privateKey string) (*Emulator, error) {
+	acc, err := account.NewAccountFromPrivatekey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Emulator{
+		keys: map[uint32]*incognitokey.KeySet{0: acc.Keyset},
+	}, nil
+}
+
+func (e *Emulator) Exchange(ctx context.Context, apdu APDU) ([]byte, error) {
+	if apdu.CLA != cla {
+		return statusWord(nil, codeCLANotSupported), nil
+	}
+	// reassemble chunked payloads: a full-size chunk of a command that
+	// expects more data is acknowledged and kept until the rest arrives
+	p1, p2, payload := apdu.P1, apdu.P2, apdu.Payload
+	if len(payload) > 0 && p1&p1More != 0 {
+		if apdu.INS != e.pendingINS {
+			return statusWord(nil, codeInvalidData), nil
+		}
+		p1 &^= p1More
+		payload = append(e.pending, payload...)
+	}
+	e.pending, e.pendingINS = nil, 0
+	if len(apdu.Payload) == maxAPDUPayload && len(payload) < expectedPayloadLen(apdu.INS, apdu.P2) {
+		e.pending, e.pendingINS = payload, apdu.INS
+		return statusWord(nil, codeSuccess), nil
+	}
+
+	var resp []byte
+	var sw uint16 = codeSuccess
+	switch apdu.INS {
+	case cmdGetVersion:
+		resp = emulatorVersion[:]
+	case cmdGetAddress, cmdGetViewKey, cmdGetPrivateKey, cmdGetOTAKey, cmdGetValidatorKey:
+		resp, sw = e.getKey(apdu.INS, payload)
+		if sw == codeSuccess && p1 == p1Confirm && e.Reject {
+			sw = codeUserRejected
+		}
+	case cmdSwitchKey:
+		if len(payload) != 4 {
+			sw = codeWrongLength
+		} else if _, err := e.keySet(binary.LittleEndian.Uint32(payload)); err != nil {
+			sw = codeInvalidData
+		} else {
+			e.active = binary.LittleEndian.Uint32(payload)
+		}
+	case cmdKeyImage:
+		resp, sw = e.keyImage(payload)
+	case cmdKeyImageBatch:
+		if p2 == 0 || len(payload) != expectedPayloadLen(cmdKeyImageBatch, p2) {
+			sw = codeWrongLength
+			break
+		}
+		for i := 0; i < len(payload); i += 64 {
+			ki, _ := e.keyImage(payload[i : i+64])
+			resp = append(resp, ki...)
+		}
+	case cmdGenAlpha:
+		resp, sw = e.genAlpha(p1)
+	case cmdCalculateC:
+		resp, sw = e.calculateC(p1, p2, payload)
+	case cmdCalculateR:
+		resp, sw = e.calculateR(p2, payload)
+	case cmdGenCoinPrivateKey:
+		resp, sw = e.genCoinPrivateKey(p1, p2, payload)
+	case cmdSignSchnorr:
+		resp, sw = e.signSchnorr(payload)
+	case cmdSignHash:
+		resp, sw = e.signHash(p2, payload)
+	case cmdTrustHost:
+	default:
+		sw = codeINSNotSupported
+	}
+	if sw != codeSuccess {
+		resp = nil
+	}
+	return statusWord(resp, sw), nil
+}
+
+func (e *Emulator) Close() error {
+	return nil
+}
+
+// keySet returns the key set of account index. The real app derives
+// accounts from its seed; the emulator derives index i > 0 by hashing the
+// base private key with i.
+func (e *Emulator) keySet(index uint32) (*incognitokey.KeySet, error) {
+	if ks, ok := e.keys[index]; ok {
+		return ks, nil
+	}
+	seed := append(append([]byte{}, e.keys[0].PrivateKey...), encodeIndex(index)...)
+	ks := new(incognitokey.KeySet)
+	if err := ks.InitFromPrivateKeyByte(operation.HashToScalar(seed).ToBytesS()); err != nil {
+		return nil, err
+	}
+	e.keys[index] = ks
+	return ks, nil
+}
+
+// getKey answers the key-returning commands, whose optional payload is the
+// little-endian account index.
+func (e *Emulator) getKey(ins byte, payload []byte) ([]byte, uint16) {
+	var index uint32
+	if len(payload) == 4 {
+		index = binary.LittleEndian.Uint32(payload)
+	} else if len(payload) != 0 {
+		return nil, codeWrongLength
+	}
+	ks, err := e.keySet(index)
+	if err != nil {
+		return nil, codeInvalidData
+	}
+	kw := wallet.KeyWallet{KeySet: *ks}
+	switch ins {
+	case cmdGetAddress:
+		return []byte(kw.Base58CheckSerialize(wallet.PaymentAddressType)), codeSuccess
+	case cmdGetViewKey:
+		return append(append([]byte{}, ks.ReadonlyKey.Pk...), ks.ReadonlyKey.Rk...), codeSuccess
+	case cmdGetPrivateKey:
+		return []byte(kw.Base58CheckSerialize(wallet.PriKeyType)), codeSuccess
+	case cmdGetOTAKey:
+		return append(ks.OTAKey.GetPublicSpend().ToBytesS(), ks.OTAKey.GetOTASecretKey().ToBytesS()...), codeSuccess
+	default: // cmdGetValidatorKey
+		return common.HashB(common.HashB(ks.PrivateKey)), codeSuccess
+	}
+}
+
+// privateScalar returns the private key of the active account.
+func (e *Emulator) privateScalar() *privacy.Scalar {
+	ks, _ := e.keySet(e.active)
+	return new(privacy.Scalar).FromBytesS(ks.PrivateKey)
+}
+
+// keyImage expects encryptKm || coinPubkey and returns
+// (encryptKm + sk) * HashToPoint(coinPubkey).
+func (e *Emulator) keyImage(payload []byte) ([]byte, uint16) {
+	if len(payload) != 64 {
+		return nil, codeWrongLength
+	}
+	coinPriv := new(privacy.Scalar).Add(new(privacy.Scalar).FromBytesS(payload[:32]), e.privateScalar())
+	hashedPub := operation.HashToPoint(payload[32:])
+	return new(privacy.Point).ScalarMult(hashedPub, coinPriv).ToBytesS(), codeSuccess
+}
+
+func (e *Emulator) genAlpha(n byte) ([]byte, uint16) {
+	if n == 0 {
+		return nil, codeWrongP1P2
+	}
+	e.alphas = make([]*privacy.Scalar, n)
+	for i := range e.alphas {
+		e.alphas[i] = operation.RandomScalar()
+	}
+	e.coinKeys = make([]*privacy.Scalar, n)
+	return nil, codeSuccess
+}
+
+// genCoinPrivateKey stores the private key of ring column idx. Regular
+// coins send their encryptKm (P1 = 0) and the app adds sk; the final
+// commitment column (P1 = 1) carries the summed randomness as-is.
+func (e *Emulator) genCoinPrivateKey(p1, idx byte, payload []byte) ([]byte, uint16) {
+	if int(idx) >= len(e.coinKeys) {
+		return nil, codeWrongP1P2
+	} else if len(payload) != 32 {
+		return nil, codeWrongLength
+	}
+	key := new(privacy.Scalar).FromBytesS(payload)
+	if p1 == 0 {
+		key.Add(key, e.privateScalar())
+	}
+	e.coinKeys[idx] = key
+	return nil, codeSuccess
+}
+
+// calculateC returns alpha*G || alpha*Rpi for the coin columns and
+// alpha*PedComG for the final commitment column (P1 = 1).
+func (e *Emulator) calculateC(p1, idx byte, payload []byte) ([]byte, uint16) {
+	if int(idx) >= len(e.alphas) {
+		return nil, codeWrongP1P2
+	}
+	p, err := new(privacy.Point).FromBytesS(payload)
+	if err != nil {
+		return nil, codeInvalidData
+	}
+	alpha := e.alphas[idx]
+	if p1 == 1 {
+		return new(privacy.Point).ScalarMult(p, alpha).ToBytesS(), codeSuccess
+	}
+	resp := new(privacy.Point).ScalarMultBase(alpha).ToBytesS()
+	return append(resp, new(privacy.Point).ScalarMult(p, alpha).ToBytesS()...), codeSuccess
+}
+
+// calculateR returns alpha - c*privKey for ring column idx.
+func (e *Emulator) calculateR(idx byte, payload []byte) ([]byte, uint16) {
+	if int(idx) >= len(e.alphas) || e.coinKeys[idx] == nil {
+		return nil, codeWrongP1P2
+	} else if len(payload) != 32 {
+		return nil, codeWrongLength
+	}
+	c := new(privacy.Scalar).FromBytesS(payload)
+	r := new(privacy.Scalar).Mul(c, e.coinKeys[idx])
+	return r.Sub(e.alphas[idx], r).ToBytesS(), codeSuccess
+}
+
+// signSchnorr expects pedRandom || pedPrivate || randomness || message and
+// signs message for the public key sk*pedPrivate + randomness*pedRandom,
+// producing the same e || z1 || z2 layout as privacy.SchnSignature.
+func (e *Emulator) signSchnorr(payload []byte) ([]byte, uint16) {
+	if len(payload) != 128 {
+		return nil, codeWrongLength
+	}
+	g, err := new(privacy.Point).FromBytesS(payload[32:64])
+	if err != nil {
+		return nil, codeInvalidData
+	}
+	sk := e.privateScalar()
+	message := payload[96:]
+
+	if bytes.Equal(payload[:32], make([]byte, 32)) {
+		// no randomness: plain Schnorr over pedPrivate
+		return plainSchnorr(sk, g, message), codeSuccess
+	}
+	h, err := new(privacy.Point).FromBytesS(payload[:32])
+	if err != nil {
+		return nil, codeInvalidData
+	}
+	r := new(privacy.Scalar).FromBytesS(payload[64:96])
+	s1 := operation.RandomScalar()
+	s2 := operation.RandomScalar()
+	t := new(privacy.Point).AddPedersen(s1, g, s2, h)
+	ch := operation.HashToScalar(append(t.ToBytesS(), message...))
+	z1 := new(privacy.Scalar).Mul(sk, ch)
+	z1.Sub(s1, z1)
+	z2 := new(privacy.Scalar).Mul(r, ch)
+	z2.Sub(s2, z2)
+	sig := append(ch.ToBytesS(), z1.ToBytesS()...)
+	return append(sig, z2.ToBytesS()...), codeSuccess
+}
+
+// signHash expects index || hash. With p2SignHash it returns a plain
+// Schnorr signature e || z1 over the hash by the account's private key;
+// with p2DisplayHash it only "displays" the hash.
+func (e *Emulator) signHash(p2 byte, payload []byte) ([]byte, uint16) {
+	if len(payload) != 36 {
+		return nil, codeWrongLength
+	} else if e.Reject {
+		return nil, codeUserRejected
+	} else if p2 == p2DisplayHash {
+		return nil, codeSuccess
+	} else if p2 != p2SignHash {
+		return nil, codeWrongP1P2
+	}
+	ks, err := e.keySet(binary.LittleEndian.Uint32(payload[:4]))
+	if err != nil {
+		return nil, codeInvalidData
+	}
+	sk := new(privacy.Scalar).FromBytesS(ks.PrivateKey)
+	g := operation.PedCom.G[operation.PedersenPrivateKeyIndex]
+	return plainSchnorr(sk, g, payload[4:]), codeSuccess
+}
+
+// plainSchnorr signs message for the public key sk*g, producing e || z1.
+func plainSchnorr(sk *privacy.Scalar, g *privacy.Point, message []byte) []byte {
+	s1 := operation.RandomScalar()
+	t := new(privacy.Point).ScalarMult(g, s1)
+	ch := operation.HashToScalar(append(t.ToBytesS(), message...))
+	z1 := new(privacy.Scalar).Mul(sk, ch)
+	z1.Sub(s1, z1)
+	return append(ch.ToBytesS(), z1.ToBytesS()...)
+}
+
+// statusWord appends the big-endian status word to resp.
+func statusWord(resp []byte, sw uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], sw)
+	return append(resp, b[:]...)
+}
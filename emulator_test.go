@@ -0,0 +1,180 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/0xkumi/incognito-dev-framework/account"
+	"github.com/incognitochain/incognito-chain/common"
+	"github.com/incognitochain/incognito-chain/privacy"
+	"github.com/incognitochain/incognito-chain/privacy/operation"
+)
+
+// testPrivateKey is the key the emulator holds in tests.
+const testPrivateKey = "111111bgk2j6vZQvzq8tkonDLLXEvLkMwBMn5BoLXLpf631boJnPDGEQMGvA1pRfT71Crr7MM2ShvpkxCBWBL2icG22cXSpcKybKCQmaxa"
+
+func newTestEmulator(t *testing.T) *Emulator {
+	t.Helper()
+	emu, err := NewEmulator(testPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emu
+}
+
+func newTestDevice(t *testing.T) *NanoS {
+	return NewNanoS(newTestEmulator(t))
+}
+
+// randomCoin returns a coin with a random public key and encrypted km.
+func randomCoin() KeyImageRequest {
+	pub := new(privacy.Point).ScalarMultBase(operation.RandomScalar())
+	return KeyImageRequest{
+		CoinPubkey: hex.EncodeToString(pub.ToBytesS()),
+		EncryptKm:  hex.EncodeToString(operation.RandomScalar().ToBytesS()),
+	}
+}
+
+// hostKeyImage computes the key image of coin for the test key on the host:
+// (km + sk) * HashToPoint(coin public key).
+func hostKeyImage(t *testing.T, coin KeyImageRequest) string {
+	t.Helper()
+	acc, err := account.NewAccountFromPrivatekey(testPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km, err := hex.DecodeString(coin.EncryptKm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := hex.DecodeString(coin.CoinPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinPriv := new(privacy.Scalar).FromBytesS(km)
+	coinPriv.Add(coinPriv, new(privacy.Scalar).FromBytesS(acc.Keyset.PrivateKey))
+	ki := new(privacy.Point).ScalarMult(operation.HashToPoint(pub), coinPriv)
+	return hex.EncodeToString(ki.ToBytesS())
+}
+
+func TestEmulatorKeyImage(t *testing.T) {
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+
+	coin := randomCoin()
+	ki, err := nanos.GenKeyImage(coin.CoinPubkey, coin.EncryptKm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hostKeyImage(t, coin); ki != want {
+		t.Fatalf("key image %s, want %s", ki, want)
+	}
+}
+
+func TestEmulatorKeyImageBatchChunked(t *testing.T) {
+	emu := newTestEmulator(t)
+	var apdus []APDU
+	nanos := NewNanoS(TransportFunc(func(ctx context.Context, apdu APDU) ([]byte, error) {
+		apdus = append(apdus, apdu)
+		return emu.Exchange(ctx, apdu)
+	}))
+	defer nanos.Close()
+
+	coins := make([]KeyImageRequest, keyImageBatchSize)
+	for i := range coins {
+		coins[i] = randomCoin()
+	}
+	kis, err := nanos.GenKeyImages(coins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 7 coins make a 448-byte payload, sent as a 255-byte chunk and the rest
+	if len(apdus) != 2 {
+		t.Fatalf("batch sent in %d APDUs, want 2", len(apdus))
+	} else if got := len(apdus[0].Payload) + len(apdus[1].Payload); got != 64*keyImageBatchSize {
+		t.Fatalf("batch payload is %d bytes, want %d", got, 64*keyImageBatchSize)
+	} else if apdus[1].P1&p1More == 0 {
+		t.Fatal("second chunk is not marked as a continuation")
+	}
+	for i, coin := range coins {
+		if want := hostKeyImage(t, coin); kis[i] != want {
+			t.Errorf("key image %d is %s, want %s", i, kis[i], want)
+		}
+	}
+}
+
+func TestEmulatorSignHash(t *testing.T) {
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+
+	hash := common.HashH([]byte("emulator sign hash test")).Bytes()
+	sig, err := nanos.SignHash(0, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := nanos.GetAddress(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := verifyHashSignature(addr, hash, sig); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("signature does not verify")
+	}
+	other := common.HashH([]byte("another hash")).Bytes()
+	if ok, _ := verifyHashSignature(addr, other, sig); ok {
+		t.Fatal("signature verifies for another hash")
+	}
+}
+
+func TestEmulatorSignHashRejected(t *testing.T) {
+	emu := newTestEmulator(t)
+	emu.Reject = true
+	nanos := NewNanoS(emu)
+	defer nanos.Close()
+
+	_, err := nanos.SignHash(0, make([]byte, 32))
+	if !errors.Is(err, ErrUserRejected) {
+		t.Fatalf("got %v, want %v", err, ErrUserRejected)
+	}
+}
+
+func TestEmulatorSignSchnorr(t *testing.T) {
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+
+	r := operation.RandomScalar()
+	pedRandom := operation.PedCom.G[operation.PedersenRandomnessIndex].GetKey()
+	pedPrivate := operation.PedCom.G[operation.PedersenPrivateKeyIndex].GetKey()
+	hash := common.HashH([]byte("emulator sign schnorr test"))
+	resp, err := nanos.SignSchnorr(pedRandom[:], pedPrivate[:], r.ToBytesS(), hash.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the signature is for sk*G[privateKey] + r*G[randomness]
+	acc, err := account.NewAccountFromPrivatekey(testPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := new(privacy.Point).FromBytesS(acc.Keyset.PaymentAddress.Pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk.Add(pk, new(operation.Point).ScalarMult(operation.PedCom.G[operation.PedersenRandomnessIndex], r))
+	verifyKey := new(privacy.SchnorrPublicKey)
+	verifyKey.Set(pk)
+
+	sig := new(privacy.SchnSignature)
+	if err := sig.SetBytes(resp); err != nil {
+		t.Fatal(err)
+	}
+	if !verifyKey.Verify(sig, hash.Bytes()) {
+		t.Fatal("signature does not verify")
+	}
+}
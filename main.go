@@ -1,16 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 	"time"
 
-	"github.com/0xkumi/incognito-dev-framework/account"
-	"github.com/incognitochain/incognito-chain/common"
-	"github.com/incognitochain/incognito-chain/privacy"
-	"github.com/incognitochain/incognito-chain/privacy/operation"
-
 	// "github.com/tendermint/tendermint/types/time"
 	"lukechampine.com/flagg"
 )
@@ -19,10 +18,28 @@ const (
 	rootUsage = `Usage:
     incognitoledger [flags] [action]
 
+Flags:
+    --device        device to use: "hid" (default, first Ledger),
+                    "path:<hid path>" or "serial:<serial>" (see devices),
+                    "emu" for the software emulator keyed by
+                    $INCOGNITO_EMULATOR_KEY (dev builds only), or a
+                    Speculos APDU socket such as tcp://127.0.0.1:9999,
+                    or replay:<file>
+    --timeout       how long to wait for the device to answer a single
+                    request (default 1m30s)
+    --trace-file    append every APDU exchanged with the device to this
+                    file (replay it later with --device replay:<file>)
+    --trace-redact  zero out keys and other secrets in the trace
+    --ignore-versions
+                    sign even if the Ledger app or CoinDaemon version is
+                    known to be incompatible with this CLI
+
 Actions:
+    devices         list attached Ledgers
     addr            generate an address
     pubkey          generate a pubkey
     hash            sign a trusted hash
+    verifyhash      check a signature made with hash
     txn             sign a transaction
 `
 
@@ -31,59 +48,134 @@ Actions:
 
 Prints the version of the incognitoledger binary, as well as the version reported by
 the Incognito Ledger Nano S app (if available).
+`
+	devicesUsage = `Usage:
+	incognitoledger devices
+
+Lists the path, serial number and model of every attached Ledger, for use
+with the --device flag.
 `
 	addrUsage = `Usage:
-	incognitoledger addr [key index]
+	incognitoledger addr [-verify] [-index n | key index]
+
+Generates an address using the public key with the specified index
+(default 0). With -verify the address is also shown on the device, and
+only printed once you confirm that both match.
+`
+	hashUsage = `Usage:
+	incognitoledger hash [-index n] [hex hash]
+
+Shows the 32-byte hash on the device and, once approved, prints a Schnorr
+signature over it made with the key of the account with the specified
+index (default 0).
+`
+	verifyHashUsage = `Usage:
+	incognitoledger verifyhash [payment address] [hex hash] [hex signature]
 
-Generates an address using the public key with the specified index.
+Checks that the signature over the hash was made with the key behind the
+payment address. No device is needed.
+`
+	trustHostUsage = ``
+	viewKeyUsage   = `Usage:
+	incognitoledger view [-index n | key index]
+
+Prints the view key of the account with the specified index (default 0).
+`
+	getOTAKeyUsage = `Usage:
+	incognitoledger ota [-index n | key index]
+
+Prints the OTA key of the account with the specified index (default 0).
+`
+	getValidatorUsage = `Usage:
+	incognitoledger getvalidator [-config file] [-index n | key index]
+
+Prints the validator (mining) key of the account with the specified index
+(default 0) together with its BLS, bridge and committee public keys. With
+-config, also writes a node config snippet setting miningkeys.
 `
-	trustHostUsage     = ``
-	viewKeyUsage       = ``
-	getOTAKeyUsage     = ``
-	getValidatorUsage  = ``
 	listAccountUsage   = ``
 	getBalanceUsage    = ``
 	updateBalanceUsage = ``
 	createTxUsage      = ``
-	importAccountUsage = ``
-	switchkeyUsage     = ``
+	importAccountUsage = `Usage:
+	incognitoledger importacc [-index n] [account name] [beacon height]
+
+Registers the account with the specified index (default 0) with the
+CoinDaemon under the given name, scanning coins from the beacon height.
+If the daemon already has the account, e.g. imported from another
+machine, only records in accounts.json which key it uses.
+`
+	switchkeyUsage = `Usage:
+	incognitoledger switchkey [key index | account name]
 
-	privUsage        = ``
-	genKeyImageUsage = ``
-	signSchnorrUsage = ``
-	benchmarkUsage   = ``
+Makes the account with the given index, or the one imported under the
+given name, the one the device signs with, and remembers it in
+accounts.json.
+`
+)
+
+// Developer-only commands, which print secrets or use embedded test keys.
+// They are only compiled into builds made with -tags dev (see dev.go).
+var (
+	devTree flagg.Tree
+	// devOffline lists the developer commands that don't use the device.
+	devOffline    []*flag.FlagSet
+	runDevCommand func(cmd *flag.FlagSet, nanos *NanoS, args []string)
 )
 
+func isDevOffline(cmd *flag.FlagSet) bool {
+	for _, c := range devOffline {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 	log.SetFlags(0)
 	rootCmd := flagg.Root
 	rootCmd.Usage = flagg.SimpleUsage(rootCmd, rootUsage)
+	deviceSpec := rootCmd.String("device", "", "device to use (hid, path:<path>, serial:<serial>, emu or tcp://host:port)")
+	timeout := rootCmd.Duration("timeout", DefaultExchangeTimeout, "deadline for a single device exchange")
+	traceFile := rootCmd.String("trace-file", "", "record APDU exchanges to this file")
+	traceRedact := rootCmd.Bool("trace-redact", false, "redact secrets in the APDU trace")
+	ignoreVersions := rootCmd.Bool("ignore-versions", false, "skip the Ledger app and CoinDaemon compatibility check")
 
 	versionCmd := flagg.New("version", versionUsage)
+	devicesCmd := flagg.New("devices", devicesUsage)
 	addrCmd := flagg.New("addr", addrUsage)
+	addrVerify := addrCmd.Bool("verify", false, "confirm the address on the device screen")
+	addrIndex := indexFlag(addrCmd)
+	hashCmd := flagg.New("hash", hashUsage)
+	hashIndex := indexFlag(hashCmd)
+	verifyHashCmd := flagg.New("verifyhash", verifyHashUsage)
 	getViewKeyCmd := flagg.New("view", viewKeyUsage)
+	viewKeyIndex := indexFlag(getViewKeyCmd)
 	getOTAKeyCmd := flagg.New("ota", getOTAKeyUsage)
+	otaKeyIndex := indexFlag(getOTAKeyCmd)
 	getValidatorCmd := flagg.New("getvalidator", getValidatorUsage)
+	validatorConfig := getValidatorCmd.String("config", "", "write a node config snippet to this file")
+	validatorIndex := indexFlag(getValidatorCmd)
 	trustHostCmd := flagg.New("trust", trustHostUsage)
 	listAccountCmd := flagg.New("listaccount", listAccountUsage)
 	getBalanceCmd := flagg.New("getbalance", getBalanceUsage)
 	updateBalanceCmd := flagg.New("updatebalance", updateBalanceUsage)
 	createTxCmd := flagg.New("createtx", createTxUsage)
 	importAccountCmd := flagg.New("importacc", importAccountUsage)
+	importIndex := indexFlag(importAccountCmd)
 	switchKeyCmd := flagg.New("switchkey", switchkeyUsage)
 
-	benchmarkCmd := flagg.New("benchmark", benchmarkUsage)
-	privCmd := flagg.New("priv", privUsage)
-	genKeyImageCmd := flagg.New("genkeyimage", genKeyImageUsage)
-	signSchnorrCmd := flagg.New("signschnorr", signSchnorrUsage)
-
-	cmd := flagg.Parse(flagg.Tree{
+	tree := flagg.Tree{
 		Cmd: rootCmd,
 		Sub: []flagg.Tree{
 			// user cmd
 			{Cmd: trustHostCmd},
 			{Cmd: versionCmd},
+			{Cmd: devicesCmd},
 			{Cmd: addrCmd},
+			{Cmd: hashCmd},
+			{Cmd: verifyHashCmd},
 			{Cmd: getViewKeyCmd},
 			{Cmd: getValidatorCmd},
 			{Cmd: getOTAKeyCmd},
@@ -93,25 +185,49 @@ func main() {
 			{Cmd: createTxCmd},
 			{Cmd: importAccountCmd},
 			{Cmd: switchKeyCmd},
-
-			// dev cmd
-			{Cmd: privCmd},
-			{Cmd: genKeyImageCmd},
-			{Cmd: signSchnorrCmd},
-			{Cmd: benchmarkCmd},
 		},
-	})
+	}
+	if devTree.Cmd != nil {
+		tree.Sub = append(tree.Sub, devTree)
+	}
+	cmd := flagg.Parse(tree)
 	args := cmd.Args()
-	fmt.Println("args", args)
-	readConfig()
+	cfg := readConfig()
+	daemon, err := cfg.coinDaemon()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ctx := context.Background()
 	var nanos *NanoS
-	if cmd != rootCmd && cmd != versionCmd && cmd != listAccountCmd && cmd != getBalanceCmd && cmd != updateBalanceCmd && cmd != createTxCmd {
-		var err error
-		nanos, err = OpenNanoS()
+	if cmd != rootCmd && cmd != versionCmd && cmd != devicesCmd && cmd != verifyHashCmd && cmd != listAccountCmd && cmd != getBalanceCmd && !isDevOffline(cmd) {
+		nanos, err = OpenDevice(*deviceSpec)
 		if err != nil {
 			log.Println("This cmd require connected to ledger device")
 			log.Fatalln("Couldn't open device:", err)
 		}
+		nanos.Timeout = *timeout
+		if *traceFile != "" {
+			f, err := os.OpenFile(*traceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Fatalln("Couldn't open trace file:", err)
+			}
+			defer f.Close()
+			nanos.Record(f, *traceRedact)
+		}
+	}
+
+	// refuse to sign with an app or daemon known not to work with this CLI
+	switch cmd {
+	case hashCmd, importAccountCmd, updateBalanceCmd, createTxCmd:
+		if !*ignoreVersions {
+			checkDaemon := daemon
+			if cmd == hashCmd {
+				checkDaemon = nil
+			}
+			if err := checkCompatibility(ctx, nanos, checkDaemon); err != nil {
+				log.Fatalln(err, "(use --ignore-versions to override)")
+			}
+		}
 	}
 
 	switch cmd {
@@ -124,77 +240,178 @@ func main() {
 	case versionCmd:
 		// try to get Nano S app version
 		var appVersion string
-		nanos, err := OpenNanoS()
+		nanos, err := OpenDevice(*deviceSpec)
 		if err != nil {
 			appVersion = "(could not connect to Nano S)"
 		} else if appVersion, err = nanos.GetVersion(); err != nil {
 			appVersion = "(could not read version from Nano S: " + err.Error() + ")"
 		}
 
+		daemonVersion, err := daemon.Version(ctx)
+		if err != nil {
+			daemonVersion = "(could not read version from CoinDaemon: " + err.Error() + ")"
+		}
+
 		fmt.Printf("CLI version: %s\n", CLI_version)
 		fmt.Println("Nano S app version:", appVersion)
-		fmt.Printf("CoinDaemon version: %s\n", CLI_version)
+		fmt.Printf("CoinDaemon version: %s\n", daemonVersion)
+	case devicesCmd:
+		ledgers := ListLedgers()
+		if len(ledgers) == 0 {
+			fmt.Println("No Ledger detected")
+		}
+		for _, l := range ledgers {
+			fmt.Printf("path:%s\tserial:%s\t%s\n", l.Path, l.Serial, l.Model)
+		}
 	case trustHostCmd:
 		err := nanos.TrustHost()
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 	case addrCmd:
-		addr, err := nanos.GetAddress()
+		index, ok := accountIndex(addrCmd, addrIndex, args)
+		if !ok {
+			addrCmd.Usage()
+			return
+		}
+		if *addrVerify {
+			fmt.Println("Please check the address shown on the device")
+			addr, err := nanos.VerifyAddress(index)
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Println(addr)
+			fmt.Println("Address confirmed on the device")
+			return
+		}
+		addr, err := nanos.GetAddress(index)
 		if err != nil {
-			log.Fatalln("Couldn't get address:", err)
+			fatal(err)
 		}
 		fmt.Println(addr)
+	case hashCmd:
+		if len(args) != 1 {
+			hashCmd.Usage()
+			return
+		}
+		hash, err := hex.DecodeString(args[0])
+		if err != nil {
+			log.Fatalln("Couldn't parse hash:", err)
+		}
+		fmt.Println("Please review the hash shown on the device")
+		sig, err := nanos.SignHash(flagIndex(*hashIndex), hash)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(hex.EncodeToString(sig))
+	case verifyHashCmd:
+		if len(args) != 3 {
+			verifyHashCmd.Usage()
+			return
+		}
+		hash, err := hex.DecodeString(args[1])
+		if err != nil {
+			log.Fatalln("Couldn't parse hash:", err)
+		}
+		sig, err := hex.DecodeString(args[2])
+		if err != nil {
+			log.Fatalln("Couldn't parse signature:", err)
+		}
+		ok, err := verifyHashSignature(args[0], hash, sig)
+		if err != nil {
+			log.Fatalln("Couldn't verify signature:", err)
+		} else if !ok {
+			log.Fatalln("Invalid signature")
+		}
+		fmt.Println("Valid signature")
 	case getViewKeyCmd:
-		_, err := nanos.GetViewKey()
+		index, ok := accountIndex(getViewKeyCmd, viewKeyIndex, args)
+		if !ok {
+			getViewKeyCmd.Usage()
+			return
+		}
+		_, err := nanos.GetViewKey(index)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 	case getOTAKeyCmd:
-		_, err := nanos.GetOTAKey()
+		index, ok := accountIndex(getOTAKeyCmd, otaKeyIndex, args)
+		if !ok {
+			getOTAKeyCmd.Usage()
+			return
+		}
+		_, err := nanos.GetOTAKey(index)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 	case getValidatorCmd:
-		err := nanos.GetValidatorKey()
+		index, ok := accountIndex(getValidatorCmd, validatorIndex, args)
+		if !ok {
+			getValidatorCmd.Usage()
+			return
+		}
+		seed, err := nanos.GetValidatorKey(index)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
+		}
+		addr, err := nanos.GetAddress(index)
+		if err != nil {
+			fatal(err)
+		}
+		keys, err := deriveValidatorKeys(seed, addr)
+		if err != nil {
+			log.Fatalln("Couldn't derive validator keys:", err)
+		}
+		fmt.Println("Validator key:       ", keys.ValidatorKey)
+		fmt.Println("BLS public key:      ", keys.BLSPublicKey)
+		fmt.Println("Bridge public key:   ", keys.BridgePublicKey)
+		fmt.Println("Committee public key:", keys.CommitteePublicKey)
+		if *validatorConfig != "" {
+			if err := writeNodeConfig(*validatorConfig, keys); err != nil {
+				log.Fatalln("Couldn't write node config:", err)
+			}
+			fmt.Println("Node config written to", *validatorConfig)
 		}
 	case listAccountCmd:
-		result, err := getAccountList()
+		result, err := daemon.AccountList(ctx)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 		for name, addr := range result {
 			fmt.Printf("%s: %s", name, addr)
 		}
 	case getBalanceCmd:
 		account := args[0]
-		result, err := getAccountBalance(account)
+		warnIfInactive(account)
+		result, err := daemon.Balance(ctx, account)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 		fmt.Println(result)
 	case updateBalanceCmd:
 		account := args[0]
-		result, err := requestUpdateBalance(account)
+		result, err := requestUpdateBalance(ctx, nanos, daemon, account)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
-		fmt.Println(result)
+		fmt.Println(result, "coins updated")
 	case createTxCmd:
 		t := time.Now()
 		txjsonLink := args[0]
-		result, err := requestCreateTx(txjsonLink)
+		result, err := requestCreateTx(ctx, nanos, daemon, txjsonLink)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 		fmt.Println(result)
 		fmt.Println("time:", time.Since(t))
 	case importAccountCmd:
+		if len(args) != 1 && len(args) != 2 {
+			importAccountCmd.Usage()
+			return
+		}
 		err := nanos.TrustHost()
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 		accountName := args[0]
 		beaconHeight := uint64(0)
@@ -202,108 +419,39 @@ func main() {
 			var err error
 			beaconHeight, err = strconv.ParseUint(args[1], 0, 64)
 			if err != nil {
-				panic(err)
+				log.Fatalln("Couldn't parse beacon height:", err)
 			}
 		}
-		viewKey, err := nanos.GetViewKey()
-		if err != nil {
-			panic(err)
-		}
-		otaKey, err := nanos.GetOTAKey()
-		if err != nil {
-			panic(err)
-		}
-		addr, err := nanos.GetAddress()
+		err = requestImportAccount(ctx, nanos, daemon, accountName, flagIndex(*importIndex), beaconHeight)
 		if err != nil {
-			log.Fatalln("Couldn't get address:", err)
-		}
-		err = importAccount(accountName, addr, otaKey, viewKey, beaconHeight)
-		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 	case switchKeyCmd:
-		err := nanos.SwitchKey()
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-	//for dev-use only
-	case privCmd:
 		if len(args) != 1 {
-			privCmd.Usage()
+			switchKeyCmd.Usage()
 			return
 		}
-		priv, err := nanos.GetPrivateKey()
-		if err != nil {
-			log.Fatalln("Couldn't get address:", err)
-		}
-		fmt.Println(priv)
-	case genKeyImageCmd:
-		err := nanos.TrustHost()
-		if err != nil {
-			log.Fatalln(err)
-		}
-		result, err := nanos.GenKeyImage("17fd6aff8fecd18243af1a83dab0e47ca5fafec256ba497b3136a6b3f68eecb1", "c4541151e39bb43e7b00ad6a1d999d609f5939ca622a9db7b7391c5190eea909")
-		if err != nil {
-			panic(err)
-		}
-		_ = result
-	case signSchnorrCmd:
-		acc0, _ := account.NewAccountFromPrivatekey("111111bgk2j6vZQvzq8tkonDLLXEvLkMwBMn5BoLXLpf631boJnPDGEQMGvA1pRfT71Crr7MM2ShvpkxCBWBL2icG22cXSpcKybKCQmaxa")
-
-		t := time.Now()
-		r := new(privacy.Scalar).FromUint64(1)
-		pedRandom := operation.PedCom.G[operation.PedersenRandomnessIndex].GetKey()
-		pedPrivate := operation.PedCom.G[operation.PedersenPrivateKeyIndex].GetKey()
-		message := "testasfdgtestasfdgfgfdgfgtestasfdgfgfdgtestasfdgfgfdgtestasfdgfgfdgfdg"
-		hash := common.HashH([]byte(message))
-		resp, err := nanos.SignSchnorr(pedRandom[:], pedPrivate[:], r.ToBytesS(), hash.Bytes())
+		state, err := loadAccountState()
 		if err != nil {
 			log.Fatalln(err)
 		}
-		fmt.Println("resp", resp, len(resp))
-		fmt.Println("signSchnorr:", time.Since(t))
-
-		//verify
-		verifyKey := new(privacy.SchnorrPublicKey)
-		metaSigPublicKey, err := new(privacy.Point).FromBytesS(acc0.Keyset.PaymentAddress.Pk)
-		if err != nil {
-			panic(err)
+		index, ok := state.resolveAccount(args[0])
+		if !ok {
+			log.Fatalf("Unknown account %q", args[0])
 		}
-		metaSigPublicKey.Add(metaSigPublicKey, new(operation.Point).ScalarMult(operation.PedCom.G[operation.PedersenRandomnessIndex], r))
-		verifyKey.Set(metaSigPublicKey)
-
-		signature := new(privacy.SchnSignature)
-		if err := signature.SetBytes(resp); err != nil {
-			panic(err)
+		if err := nanos.SwitchKey(index); err != nil {
+			fatal(err)
 		}
-		fmt.Println("verify sig", verifyKey.Verify(signature, hash.Bytes()))
-	case benchmarkCmd:
-		err := nanos.TrustHost()
-		if err != nil {
+		state.Active = index
+		if err := state.save(); err != nil {
 			log.Fatalln(err)
 		}
-		t := time.Now()
-		for i := 0; i < 20; i++ {
-			result, err := nanos.GenKeyImage("17fd6aff8fecd18243af1a83dab0e47ca5fafec256ba497b3136a6b3f68eecb1", "c4541151e39bb43e7b00ad6a1d999d609f5939ca622a9db7b7391c5190eea909")
-			if err != nil {
-				panic(err)
-			}
-			_ = result
-		}
-		fmt.Println("genKeyImage 20:", time.Since(t))
+		fmt.Println("Active key:", index)
 
-		t = time.Now()
-		r := new(privacy.Scalar).FromUint64(1)
-		pedRandom := operation.PedCom.G[operation.PedersenRandomnessIndex].GetKey()
-		pedPrivate := operation.PedCom.G[operation.PedersenPrivateKeyIndex].GetKey()
-		message := "testasfdgtestasfdgfgfdgfgtestasfdgfgfdgtestasfdgfgfdgtestasfdgfgfdgfdg"
-		hash := common.HashH([]byte(message))
-		resp, err := nanos.SignSchnorr(pedRandom[:], pedPrivate[:], r.ToBytesS(), hash.Bytes())
-		if err != nil {
-			log.Fatalln(err)
+	//for dev-use only
+	default:
+		if runDevCommand != nil {
+			runDevCommand(cmd, nanos, args)
 		}
-		_ = resp
-		fmt.Println("signSchnorr:", time.Since(t))
 	}
 }
@@ -0,0 +1,182 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// startMockDaemon serves mock, usually a *MockDaemon, and returns a client
+// for it.
+func startMockDaemon(t *testing.T, mock http.Handler) (*CoinDaemon, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(mock)
+	daemon, err := NewCoinDaemon(srv.URL, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return daemon, srv
+}
+
+// writeTxFile writes a transaction JSON for account and returns its path.
+func writeTxFile(t *testing.T, account string) string {
+	t.Helper()
+	path := "tx_transferprv.json"
+	data := []byte(`{"account": "` + account + `", "type": "transferprv", "params": ""}`)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMockDaemonRoundTrip(t *testing.T) {
+	defer inTempDir(t)()
+	mock := NewMockDaemon()
+	mock.CoinsPerImport = 3
+	daemon, srv := startMockDaemon(t, mock)
+	defer srv.Close()
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+	ctx := context.Background()
+
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	balance, err := daemon.Balance(ctx, "testacc")
+	if err != nil {
+		t.Fatal(err)
+	} else if balance[mockPRVTokenID] != 0 {
+		t.Fatalf("balance before updatebalance is %d, want 0", balance[mockPRVTokenID])
+	}
+
+	updated, err := requestUpdateBalance(ctx, nanos, daemon, "testacc")
+	if err != nil {
+		t.Fatal(err)
+	} else if updated != mock.CoinsPerImport {
+		t.Fatalf("%d coins accepted, want %d", updated, mock.CoinsPerImport)
+	}
+	balance, err = daemon.Balance(ctx, "testacc")
+	if err != nil {
+		t.Fatal(err)
+	} else if want := uint64(6e9); balance[mockPRVTokenID] != want {
+		t.Fatalf("balance is %d, want %d", balance[mockPRVTokenID], want)
+	}
+
+	txID, err := requestCreateTx(ctx, nanos, daemon, writeTxFile(t, "testacc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := mock.Transactions()
+	if len(txs) != 1 {
+		t.Fatalf("daemon saw %d transactions, want 1", len(txs))
+	} else if txs[0].Err != nil {
+		t.Fatal(txs[0].Err)
+	} else if txs[0].TxID == "" {
+		t.Fatal("empty txID")
+	} else if txs[0].TxID != txID {
+		t.Fatalf("daemon recorded tx %s, CLI got %s", txs[0].TxID, txID)
+	} else if txs[0].Account != "testacc" {
+		t.Fatalf("tx spends from %q, want testacc", txs[0].Account)
+	}
+	balance, err = daemon.Balance(ctx, "testacc")
+	if err != nil {
+		t.Fatal(err)
+	} else if balance[mockPRVTokenID] != 0 {
+		t.Fatalf("balance after spending every coin is %d, want 0", balance[mockPRVTokenID])
+	}
+}
+
+func TestAccountImportedElsewhere(t *testing.T) {
+	defer inTempDir(t)()
+	mock := NewMockDaemon()
+	mock.CoinsPerImport = 2
+	daemon, srv := startMockDaemon(t, mock)
+	defer srv.Close()
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+	ctx := context.Background()
+
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// as if imported from another machine: accounts.json doesn't know it
+	if err := os.Remove(accountStateFile); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := requestUpdateBalance(ctx, nanos, daemon, "testacc"); err != nil {
+		t.Fatal(err)
+	} else if updated != mock.CoinsPerImport {
+		t.Fatalf("%d coins accepted, want %d", updated, mock.CoinsPerImport)
+	}
+
+	// importing it again records its key
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadAccountState()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, ok := state.Accounts["testacc"]; !ok {
+		t.Fatal("account not recorded after importing it again")
+	}
+	// but not under a key with another address
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 1, 0); err == nil {
+		t.Fatal("recorded an account under a key with another address")
+	}
+}
+
+func TestCreateTxFailed(t *testing.T) {
+	defer inTempDir(t)()
+	mock := NewMockDaemon()
+	mock.CoinsPerImport = 2
+	daemon, srv := startMockDaemon(t, mock)
+	defer srv.Close()
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+	ctx := context.Background()
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// without updatebalance nothing can be spent, so the daemon gives up
+	txID, err := requestCreateTx(ctx, nanos, daemon, writeTxFile(t, "testacc"))
+	var derr *DaemonError
+	if !errors.As(err, &derr) || derr.CloseCode != websocket.CloseInternalServerErr {
+		t.Fatalf("got tx %q, error %v; want the daemon closing with %d", txID, err, websocket.CloseInternalServerErr)
+	}
+	if txs := mock.Transactions(); len(txs) != 1 || txs[0].Err == nil {
+		t.Fatalf("daemon recorded %+v, want one failed transaction", txs)
+	}
+}
+
+func TestCreateTxMalformedRequest(t *testing.T) {
+	defer inTempDir(t)()
+	var upgrader websocket.Upgrader
+	daemon, srv := startMockDaemon(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.ReadMessage()
+		c.WriteMessage(websocket.TextMessage, []byte("not a request"))
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+
+	if txID, err := requestCreateTx(context.Background(), nanos, daemon, writeTxFile(t, "testacc")); err == nil {
+		t.Fatalf("malformed request from the daemon ended in tx %q", txID)
+	}
+}
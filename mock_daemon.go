@@ -0,0 +1,556 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/incognitochain/incognito-chain/common"
+	"github.com/incognitochain/incognito-chain/privacy"
+	"github.com/incognitochain/incognito-chain/privacy/operation"
+)
+
+// mockPRVTokenID is the token ID coins added by MockDaemon.CoinsPerImport
+// belong to.
+const mockPRVTokenID = "0000000000000000000000000000000000000000000000000000000000000004"
+
+// mockCloseReasonMax is how much of an error fits the reason of a
+// websocket close frame.
+const mockCloseReasonMax = 123
+
+// mockAuthMaxSkew is how far the timestamp of an HMAC-signed request may be
+// from the mock daemon's clock.
+const mockAuthMaxSkew = 5 * time.Minute
+
+// MockDaemon is an in-memory CoinDaemon. It serves every endpoint
+// CoinDaemon calls, including the /createtx websocket negotiation, so the
+// importacc, getbalance, updatebalance and createtx paths can run against
+// it and the Emulator without a chain or a device.
+//
+// It does not scan a chain: coins are added with AddCoin, or on import
+// with CoinsPerImport. A coin counts towards the balance once its key image
+// was submitted, and a transaction spends every such coin of its account.
+// The cryptography of key images and signatures is not checked, only the
+// shape of what the CLI sends.
+type MockDaemon struct {
+	// Version is what /version reports.
+	Version string
+	// CoinsPerImport is how many random PRV coins an account gets when it
+	// is imported.
+	CoinsPerImport int
+	// Auth, if set, is required of every request, as CoinDaemon sends it.
+	Auth *DaemonAuthConfig
+	// Seed, if set, makes the coins and the randomness of transactions
+	// derive from it, so two mock daemons with the same seed send the
+	// device the same requests.
+	Seed []byte
+
+	mu       sync.Mutex
+	draws    uint64
+	accounts map[string]*mockAccount
+	txs      []MockTx
+	nonces   map[string]time.Time
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
+}
+
+type mockAccount struct {
+	ImportAccountRequest
+	// coins by token ID and coin public key (hex)
+	coins map[string]map[string]*mockCoin
+}
+
+type mockCoin struct {
+	EncryptKm string
+	Amount    uint64
+	KeyImage  string
+}
+
+// MockTx records a /createtx negotiation.
+type MockTx struct {
+	Account string
+	// Request is the transaction JSON the CLI sent.
+	Request json.RawMessage
+	// TxID is the ID sent back with the result; empty if it failed.
+	TxID string
+	Err  error
+}
+
+// NewMockDaemon returns a mock daemon without accounts.
+func NewMockDaemon() *MockDaemon {
+	m := &MockDaemon{
+		Version:  compatibleDaemonVersions[0].Min,
+		accounts: make(map[string]*mockAccount),
+		nonces:   make(map[string]time.Time),
+		mux:      http.NewServeMux(),
+	}
+	m.mux.HandleFunc("/version", m.handleVersion)
+	m.mux.HandleFunc("/getaccountlist", m.handleAccountList)
+	m.mux.HandleFunc("/getbalance", m.handleBalance)
+	m.mux.HandleFunc("/getcoinstodecrypt", m.handleCoinsToDecrypt)
+	m.mux.HandleFunc("/submitkeyimages", m.handleSubmitKeyImages)
+	m.mux.HandleFunc("/importaccount", m.handleImportAccount)
+	m.mux.HandleFunc("/createtx", m.handleCreateTx)
+	return m
+}
+
+func (m *MockDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := m.checkAuth(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	m.mux.ServeHTTP(w, r)
+}
+
+// AddCoin gives account a coin of tokenID whose key image is not known
+// yet. coinPubkey and encryptKm are hex.
+func (m *MockDaemon) AddCoin(account, tokenID, coinPubkey, encryptKm string, amount uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acc, ok := m.accounts[account]
+	if !ok {
+		return fmt.Errorf("unknown account %q", account)
+	}
+	if acc.coins[tokenID] == nil {
+		acc.coins[tokenID] = make(map[string]*mockCoin)
+	}
+	acc.coins[tokenID][coinPubkey] = &mockCoin{EncryptKm: encryptKm, Amount: amount}
+	return nil
+}
+
+// Transactions returns the /createtx negotiations so far.
+func (m *MockDaemon) Transactions() []MockTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockTx(nil), m.txs...)
+}
+
+// checkAuth verifies a request the way a daemon configured with m.Auth
+// would.
+func (m *MockDaemon) checkAuth(r *http.Request, body []byte) error {
+	if m.Auth == nil {
+		return nil
+	}
+	authz := r.Header.Get("Authorization")
+	if m.Auth.Type == "bearer" {
+		if !hmac.Equal([]byte(authz), []byte("Bearer "+m.Auth.Token)) {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+
+	var keyID, sig string
+	for _, field := range strings.Split(strings.TrimPrefix(authz, "HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "KeyId":
+			keyID = kv[1]
+		case "Signature":
+			sig = kv[1]
+		}
+	}
+	if keyID != m.Auth.KeyID {
+		return errors.New("unknown key")
+	}
+	timestamp := r.Header.Get(daemonTimestampHeader)
+	nonce := r.Header.Get(daemonNonceHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	} else if skew := time.Since(time.Unix(unix, 0)); skew > mockAuthMaxSkew || skew < -mockAuthMaxSkew {
+		return errors.New("stale timestamp")
+	}
+	secret, err := hex.DecodeString(m.Auth.Secret)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", r.Method, r.URL.RequestURI(), timestamp, nonce, sha256.Sum256(body))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return errors.New("invalid signature")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for n, seen := range m.nonces {
+		if time.Since(seen) > 2*mockAuthMaxSkew {
+			delete(m.nonces, n)
+		}
+	}
+	if _, ok := m.nonces[nonce]; ok {
+		return errors.New("replayed nonce")
+	}
+	m.nonces[nonce] = time.Now()
+	return nil
+}
+
+// randomScalar returns a random scalar, or the next one derived from Seed.
+func (m *MockDaemon) randomScalar() *privacy.Scalar {
+	if m.Seed == nil {
+		return operation.RandomScalar()
+	}
+	m.mu.Lock()
+	draw := m.draws
+	m.draws++
+	m.mu.Unlock()
+	return operation.HashToScalar(append(append([]byte(nil), m.Seed...), []byte(strconv.FormatUint(draw, 10))...))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// account returns the account named by the "account" query parameter,
+// answering the request itself if there is none.
+func (m *MockDaemon) account(w http.ResponseWriter, r *http.Request) *mockAccount {
+	name := r.URL.Query().Get("account")
+	acc, ok := m.accounts[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown account %q", name), http.StatusNotFound)
+	}
+	return acc
+}
+
+func (m *MockDaemon) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct{ Version string }{m.Version})
+}
+
+func (m *MockDaemon) handleAccountList(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]string)
+	for name, acc := range m.accounts {
+		result[name] = acc.PaymentAddress
+	}
+	writeJSON(w, result)
+}
+
+func (m *MockDaemon) handleBalance(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acc := m.account(w, r)
+	if acc == nil {
+		return
+	}
+	balance := make(map[string]uint64)
+	for tokenID, coins := range acc.coins {
+		for _, coin := range coins {
+			if coin.KeyImage != "" {
+				balance[tokenID] += coin.Amount
+			}
+		}
+	}
+	writeJSON(w, struct {
+		Address string
+		Balance map[string]uint64
+	}{acc.PaymentAddress, balance})
+}
+
+func (m *MockDaemon) handleCoinsToDecrypt(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acc := m.account(w, r)
+	if acc == nil {
+		return
+	}
+	result := make(map[string]map[string]string)
+	for tokenID, coins := range acc.coins {
+		for coinPk, coin := range coins {
+			if coin.KeyImage != "" {
+				continue
+			}
+			if result[tokenID] == nil {
+				result[tokenID] = make(map[string]string)
+			}
+			result[tokenID][coinPk] = coin.EncryptKm
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (m *MockDaemon) handleSubmitKeyImages(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Account   string
+		Keyimages map[string]map[string]string
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acc, ok := m.accounts[req.Account]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown account %q", req.Account), http.StatusNotFound)
+		return
+	}
+	result := KeyImageSubmitResult{Rejected: make(map[string]string)}
+	for tokenID, kis := range req.Keyimages {
+		for coinPk, ki := range kis {
+			coin, ok := acc.coins[tokenID][coinPk]
+			if raw, err := hex.DecodeString(ki); err != nil || len(raw) != 32 {
+				result.Rejected[coinPk] = "invalid key image"
+			} else if !ok {
+				result.Rejected[coinPk] = "unknown coin"
+			} else {
+				coin.KeyImage = ki
+				result.Accepted++
+			}
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (m *MockDaemon) handleImportAccount(w http.ResponseWriter, r *http.Request) {
+	var req ImportAccountRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if req.AccountName == "" || req.PaymentAddress == "" || req.OTAKey == "" || req.Viewkey == "" {
+		http.Error(w, "missing account name or keys", http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	if _, ok := m.accounts[req.AccountName]; ok {
+		m.mu.Unlock()
+		http.Error(w, fmt.Sprintf("account %q already exists", req.AccountName), http.StatusConflict)
+		return
+	}
+	m.accounts[req.AccountName] = &mockAccount{
+		ImportAccountRequest: req,
+		coins:                make(map[string]map[string]*mockCoin),
+	}
+	m.mu.Unlock()
+	for i := 0; i < m.CoinsPerImport; i++ {
+		coinPk := new(privacy.Point).ScalarMultBase(m.randomScalar()).ToBytesS()
+		km := m.randomScalar().ToBytesS()
+		m.AddCoin(req.AccountName, mockPRVTokenID, hex.EncodeToString(coinPk), hex.EncodeToString(km), uint64(i+1)*1e9)
+	}
+	writeJSON(w, struct{}{})
+}
+
+func (m *MockDaemon) handleCreateTx(w http.ResponseWriter, r *http.Request) {
+	c, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return
+	}
+	var txReq struct {
+		Account string `json:"account"`
+	}
+	tx := MockTx{Request: data}
+	if err := json.Unmarshal(data, &txReq); err != nil {
+		tx.Err = fmt.Errorf("invalid transaction: %v", err)
+	} else {
+		tx.Account = txReq.Account
+		tx.TxID, tx.Err = m.negotiate(c, txReq.Account)
+	}
+	// record the transaction before the CLI learns its ID
+	m.mu.Lock()
+	m.txs = append(m.txs, tx)
+	m.mu.Unlock()
+	if tx.Err != nil {
+		reason := tx.Err.Error()
+		if len(reason) > mockCloseReasonMax {
+			reason = reason[:mockCloseReasonMax]
+		}
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason))
+		return
+	}
+	result, err := json.Marshal(LedgerRequest{Cmd: "result", Data: []byte(tx.TxID)})
+	if err != nil {
+		return
+	}
+	if err := c.WriteMessage(websocket.TextMessage, result); err != nil {
+		log.Printf("mock daemon: couldn't send the result of tx %s: %v", tx.TxID, err)
+	}
+}
+
+// mockInput is a coin spent by a transaction.
+type mockInput struct {
+	tokenID, coinPubkey string
+	encryptKm           string
+}
+
+// spendable returns the coins of account whose key images are known.
+func (m *MockDaemon) spendable(account string) ([]mockInput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acc, ok := m.accounts[account]
+	if !ok {
+		return nil, fmt.Errorf("unknown account %q", account)
+	}
+	var inputs []mockInput
+	for tokenID, tokenCoins := range acc.coins {
+		for coinPk, coin := range tokenCoins {
+			if coin.KeyImage != "" {
+				inputs = append(inputs, mockInput{tokenID, coinPk, coin.EncryptKm})
+			}
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("no spendable coins, run updatebalance first")
+	}
+	// in a fixed order, so a seeded daemon repeats its requests
+	sort.Slice(inputs, func(i, j int) bool {
+		if inputs[i].tokenID != inputs[j].tokenID {
+			return inputs[i].tokenID < inputs[j].tokenID
+		}
+		return inputs[i].coinPubkey < inputs[j].coinPubkey
+	})
+	return inputs, nil
+}
+
+// negotiate drives the device through a ring signature over the spendable
+// coins of account, one column per coin plus the commitment column, the
+// way the daemon does for a real transaction.
+func (m *MockDaemon) negotiate(c *websocket.Conn, account string) (string, error) {
+	inputs, err := m.spendable(account)
+	if err != nil {
+		return "", err
+	}
+	columns := len(inputs) + 1
+
+	call := func(cmd string, data interface{}) ([]byte, error) {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := json.Marshal(LedgerRequest{Cmd: cmd, Data: raw})
+		if err != nil {
+			return nil, err
+		}
+		if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return nil, err
+		}
+		_, resp, err := c.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cmd, err)
+		}
+		return resp, nil
+	}
+
+	resp, err := call("genalpha", struct{ AlphaLength int }{columns})
+	if err != nil {
+		return "", err
+	} else if string(resp) != "success" {
+		return "", fmt.Errorf("genalpha: unexpected response %q", resp)
+	}
+
+	sumRand := new(privacy.Scalar).FromUint64(0)
+	var coinsH, rpi [][]byte
+	for _, in := range inputs {
+		km, err := hex.DecodeString(in.encryptKm)
+		if err != nil {
+			return "", err
+		}
+		coinsH = append(coinsH, km)
+		pub, err := hex.DecodeString(in.coinPubkey)
+		if err != nil {
+			return "", err
+		}
+		rpi = append(rpi, operation.HashToPoint(pub).ToBytesS())
+		sumRand.Add(sumRand, m.randomScalar())
+	}
+	coinsH = append(coinsH, sumRand.ToBytesS())
+	rpi = append(rpi, nil)
+
+	resp, err = call("gencoinprivate", struct{ CoinsH [][]byte }{coinsH})
+	if err != nil {
+		return "", err
+	} else if string(resp) != "success" {
+		return "", fmt.Errorf("gencoinprivate: unexpected response %q", resp)
+	}
+
+	pedComG := operation.PedCom.G[operation.PedersenRandomnessIndex].ToBytesS()
+	resp, err = call("calculatec", struct {
+		Rpi     [][]byte
+		PedComG []byte
+	}{rpi, pedComG})
+	if err != nil {
+		return "", err
+	} else if want := 64*len(inputs) + 32; len(resp) != want {
+		return "", fmt.Errorf("calculatec: got %d bytes, want %d", len(resp), want)
+	}
+
+	cpi := operation.HashToScalar(resp).ToBytesS()
+	resp, err = call("calculater", struct {
+		CoinLength int
+		Cpi        []byte
+	}{columns, cpi})
+	if err != nil {
+		return "", err
+	}
+	var rs [][]byte
+	if err := json.Unmarshal(resp, &rs); err != nil {
+		return "", fmt.Errorf("calculater: %v", err)
+	} else if len(rs) != columns {
+		return "", fmt.Errorf("calculater: got %d responses, want %d", len(rs), columns)
+	}
+	for _, r := range rs {
+		if len(r) != 32 {
+			return "", fmt.Errorf("calculater: got a %d-byte response, want 32", len(r))
+		}
+	}
+
+	message := common.HashH(resp)
+	pedPrivate := operation.PedCom.G[operation.PedersenPrivateKeyIndex].ToBytesS()
+	sig, err := call("signschnorr", struct {
+		PedRandom  []byte
+		PedPrivate []byte
+		Randomness []byte
+		Message    []byte
+	}{pedComG, pedPrivate, m.randomScalar().ToBytesS(), message.Bytes()})
+	if err != nil {
+		return "", err
+	} else if len(sig) != 96 {
+		return "", fmt.Errorf("signschnorr: got %d bytes, want 96", len(sig))
+	}
+
+	txID := common.HashH(append(message.Bytes(), sig...)).String()
+	m.mu.Lock()
+	for _, in := range inputs {
+		delete(m.accounts[account].coins[in.tokenID], in.coinPubkey)
+	}
+	m.mu.Unlock()
+	log.Printf("mock daemon: %s spent %d coins in tx %s", account, len(inputs), txID)
+	return txID, nil
+}
@@ -2,58 +2,202 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/zondax/hid"
 )
 
+const ledgerVendorID = 0x2c97
+
+// ledgerModels maps the high byte of a current Ledger product ID (e.g.
+// 0x1011, where the low byte lists the USB interfaces) to the model name.
+var ledgerModels = map[uint16]string{
+	0x10: "Nano S",
+	0x40: "Nano X",
+	0x50: "Nano S Plus",
+	0x60: "Stax",
+}
+
+// ledgerLegacyModels maps the product IDs reported by old firmware.
+var ledgerLegacyModels = map[uint16]string{
+	0x0000: "Ledger Blue",
+	0x0001: "Nano S",
+	0x0004: "Nano X",
+	0x0005: "Nano S Plus",
+	0x0006: "Stax",
+}
+
+// ledgerModel returns the model name of a Ledger product ID.
+func ledgerModel(productID uint16) string {
+	if name, ok := ledgerLegacyModels[productID]; ok {
+		return name
+	} else if name, ok := ledgerModels[productID>>8]; ok && productID > 0xff {
+		return name
+	}
+	return fmt.Sprintf("unknown (0x%04x)", productID)
+}
+
+// LedgerInfo describes a Ledger attached over USB HID.
+type LedgerInfo struct {
+	Path   string
+	Serial string
+	Model  string
+
+	info hid.DeviceInfo
+}
+
+// ListLedgers returns the APDU interface of every attached Ledger.
+func ListLedgers() []LedgerInfo {
+	var ledgers []LedgerInfo
+	for _, info := range hid.Enumerate(ledgerVendorID, 0) {
+		// skip the FIDO/U2F and other secondary interfaces
+		if info.Interface != 0 && info.UsagePage != 0xffa0 {
+			continue
+		}
+		ledgers = append(ledgers, LedgerInfo{
+			Path:   info.Path,
+			Serial: info.Serial,
+			Model:  ledgerModel(info.ProductID),
+			info:   info,
+		})
+	}
+	return ledgers
+}
+
+// OpenNanoS opens the first Ledger attached over USB HID.
 func OpenNanoS() (*NanoS, error) {
-	const (
-		ledgerVendorID       = 0x2c97
-		ledgerNanoSProductID = 0x0001
-	)
+	ledgers := ListLedgers()
+	if len(ledgers) == 0 {
+		return nil, errors.New("Ledger not detected")
+	} else if len(ledgers) > 1 {
+		log.Printf("%d Ledgers detected, using %s at %s (select one with --device)", len(ledgers), ledgers[0].Model, ledgers[0].Path)
+	}
+	return OpenLedger(ledgers[0])
+}
 
-	// search for Nano S
-	devices := hid.Enumerate(ledgerVendorID, ledgerNanoSProductID)
-	if len(devices) == 0 {
-		return nil, errors.New("Nano S not detected")
+// OpenLedgerMatching opens the only attached Ledger whose path or serial
+// number (as selected by field) equals value.
+func OpenLedgerMatching(field, value string) (*NanoS, error) {
+	var found []LedgerInfo
+	for _, l := range ListLedgers() {
+		if (field == "path" && l.Path == value) || (field == "serial" && l.Serial == value) {
+			found = append(found, l)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no Ledger with %s %q", field, value)
+	} else if len(found) > 1 {
+		return nil, fmt.Errorf("%d Ledgers with %s %q", len(found), field, value)
 	}
+	return OpenLedger(found[0])
+}
+
+// OpenLedger opens the given Ledger.
+func OpenLedger(l LedgerInfo) (*NanoS, error) {
+	t, err := openLedgerTransport(l)
+	if err != nil {
+		return nil, err
+	}
+	n := NewNanoS(t)
+	n.reopen = func() (Transport, error) {
+		// after a timeout or lock the device keeps its HID path. The path
+		// usually changes when it is replugged, so then look it up again by
+		// serial number. Serials are not unique (every Nano S reports 0001),
+		// so give up rather than guess between several.
+		ledgers := ListLedgers()
+		for _, candidate := range ledgers {
+			if candidate.Path == l.Path {
+				return openLedgerTransport(candidate)
+			}
+		}
+		var found []LedgerInfo
+		for _, candidate := range ledgers {
+			if candidate.Serial == l.Serial {
+				found = append(found, candidate)
+			}
+		}
+		switch len(found) {
+		case 0:
+			return nil, errors.New("Ledger not detected")
+		case 1:
+			return openLedgerTransport(found[0])
+		default:
+			return nil, fmt.Errorf("%d Ledgers with serial %q attached, can't tell which one to reconnect to (unplug the others)", len(found), l.Serial)
+		}
+	}
+	return n, nil
+}
 
-	// open the device
-	device, err := devices[0].Open()
+func openLedgerTransport(l LedgerInfo) (Transport, error) {
+	device, err := l.info.Open()
 	if err != nil {
 		return nil, err
 	}
 
 	// wrap raw device I/O in HID+APDU protocols
-	return &NanoS{
-		device: &apduFramer{
-			hf: &hidFramer{
-				rw: device,
-			},
+	return &apduFramer{
+		hf: &hidFramer{
+			rw: device,
 		},
 	}, nil
 }
 
+// hidPacketSize is the size of the HID reports exchanged with a Ledger.
+const hidPacketSize = 64
+
+const (
+	hidChannel = 0x0101
+	hidTagAPDU = 0x05
+)
+
+var (
+	// ErrDeviceDisconnected is returned once the device stops answering
+	// reads or writes, e.g. because it was unplugged.
+	ErrDeviceDisconnected = errors.New("device disconnected")
+	// ErrDeviceTimeout is returned when an exchange misses its deadline.
+	ErrDeviceTimeout = errors.New("device did not answer in time")
+)
+
 type hidFramer struct {
-	rw  io.ReadWriter
-	seq uint16
-	buf [64]byte
-	pos int
+	rw io.ReadWriteCloser
+
+	mu     sync.Mutex
+	closed bool
+	// reading is set while a report read is in flight. hidapi frees the
+	// handle on close, so Close leaves it to the reader then.
+	reading bool
+
+	// onPacket, if set, is told how long each report took to write or read.
+	onPacket func(time.Duration)
 }
 
-func (hf *hidFramer) Reset() {
-	hf.seq = 0
+// hidRead is the outcome of a single report read.
+type hidRead struct {
+	packet []byte
+	err    error
 }
 
-func (hf *hidFramer) Write(p []byte) (int, error) {
+func (hf *hidFramer) isClosed() bool {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	return hf.closed
+}
+
+func (hf *hidFramer) writeAPDU(p []byte) error {
+	if hf.isClosed() {
+		return ErrDeviceDisconnected
+	}
 	// split into 64-byte chunks
-	chunk := make([]byte, 64)
-	binary.BigEndian.PutUint16(chunk[:2], 0x0101)
-	chunk[2] = 0x05
+	chunk := make([]byte, hidPacketSize)
+	binary.BigEndian.PutUint16(chunk[:2], hidChannel)
+	chunk[2] = hidTagAPDU
 	var seq uint16
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, uint16(len(p)))
@@ -61,43 +205,117 @@ func (hf *hidFramer) Write(p []byte) (int, error) {
 	for buf.Len() > 0 {
 		binary.BigEndian.PutUint16(chunk[3:5], seq)
 		n, _ := buf.Read(chunk[5:])
-		if n, err := hf.rw.Write(chunk[:5+n]); err != nil {
-			return n, err
+		start := time.Now()
+		if _, err := hf.rw.Write(chunk[:5+n]); err != nil {
+			hf.Close()
+			return fmt.Errorf("%w: %v", ErrDeviceDisconnected, err)
+		}
+		if hf.onPacket != nil {
+			hf.onPacket(time.Since(start))
 		}
 		seq++
 	}
-	return len(p), nil
-}
-
-func (hf *hidFramer) Read(p []byte) (int, error) {
-	if hf.seq > 0 && hf.pos != 64 {
-		// drain buf
-		n := copy(p, hf.buf[hf.pos:])
-		hf.pos += n
-		return n, nil
-	}
-	// read next 64-byte packet
-	if n, err := hf.rw.Read(hf.buf[:]); err != nil {
-		return 0, err
-	} else if n != 64 {
-		panic("read less than 64 bytes from HID")
-	}
-	// parse header
-	channelID := binary.BigEndian.Uint16(hf.buf[:2])
-	commandTag := hf.buf[2]
-	seq := binary.BigEndian.Uint16(hf.buf[3:5])
-	if channelID != 0x0101 {
-		return 0, fmt.Errorf("bad channel ID 0x%x", channelID)
-	} else if commandTag != 0x05 {
-		return 0, fmt.Errorf("bad command tag 0x%x", commandTag)
-	} else if seq != hf.seq {
-		return 0, fmt.Errorf("bad sequence number %v (expected %v)", seq, hf.seq)
-	}
-	hf.seq++
-	// start filling p
-	n := copy(p, hf.buf[5:])
-	hf.pos = 5 + n
-	return n, nil
+	return nil
+}
+
+// readPacket reads the next 64-byte report. A pending HID read cannot be
+// interrupted, so when ctx expires the framer is closed and the read is
+// abandoned; the device is released once it returns.
+func (hf *hidFramer) readPacket(ctx context.Context) ([]byte, error) {
+	hf.mu.Lock()
+	if hf.closed {
+		hf.mu.Unlock()
+		return nil, ErrDeviceDisconnected
+	}
+	hf.reading = true
+	hf.mu.Unlock()
+
+	ch := make(chan hidRead, 1)
+	start := time.Now()
+	go hf.read(ch)
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			hf.Close()
+			return nil, fmt.Errorf("%w: %v", ErrDeviceDisconnected, r.err)
+		} else if len(r.packet) != hidPacketSize {
+			return nil, fmt.Errorf("read %d bytes from HID, expected %d", len(r.packet), hidPacketSize)
+		}
+		if hf.onPacket != nil {
+			hf.onPacket(time.Since(start))
+		}
+		return r.packet, nil
+	case <-ctx.Done():
+		hf.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrDeviceTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// read reads one report into ch, and closes the device if the framer was
+// closed while it waited.
+func (hf *hidFramer) read(ch chan<- hidRead) {
+	packet := make([]byte, hidPacketSize)
+	n, err := hf.rw.Read(packet)
+
+	hf.mu.Lock()
+	hf.reading = false
+	closed := hf.closed
+	hf.mu.Unlock()
+	if closed {
+		hf.rw.Close()
+	}
+	ch <- hidRead{packet[:n], err}
+}
+
+// readAPDU reassembles a response from its reports. Reports on another
+// channel and continuation reports left over from an abandoned exchange are
+// skipped, so the framer resynchronises on the first report of the reply.
+func (hf *hidFramer) readAPDU(ctx context.Context) ([]byte, error) {
+	var resp []byte
+	var respLen int
+	for seq := uint16(0); seq == 0 || len(resp) < respLen; {
+		packet, err := hf.readPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// parse header
+		channelID := binary.BigEndian.Uint16(packet[:2])
+		commandTag := packet[2]
+		packetSeq := binary.BigEndian.Uint16(packet[3:5])
+		if channelID != hidChannel || commandTag != hidTagAPDU {
+			continue
+		} else if packetSeq != seq {
+			if seq == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("bad sequence number %v (expected %v)", packetSeq, seq)
+		}
+		data := packet[5:]
+		if seq == 0 {
+			respLen = int(binary.BigEndian.Uint16(data[:2]))
+			data = data[2:]
+		}
+		resp = append(resp, data...)
+		seq++
+	}
+	return resp[:respLen], nil
+}
+
+func (hf *hidFramer) Close() error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	if hf.closed {
+		return nil
+	}
+	hf.closed = true
+	if hf.reading {
+		// read closes the device once hid_read returns
+		return nil
+	}
+	return hf.rw.Close()
 }
 
 type APDU struct {
@@ -107,57 +325,230 @@ type APDU struct {
 	Payload []byte
 }
 
-type apduFramer struct {
-	hf  *hidFramer
-	buf [2]byte // to read APDU length prefix
-}
-
-func (af *apduFramer) Exchange(apdu APDU) ([]byte, error) {
-	if len(apdu.Payload) > 255 {
-		panic("APDU payload cannot exceed 255 bytes")
-	}
-	af.hf.Reset()
-	data := append([]byte{
+// encode serializes the APDU as CLA INS P1 P2 Lc followed by the payload.
+func (apdu APDU) encode() []byte {
+	return append([]byte{
 		apdu.CLA,
 		apdu.INS,
 		apdu.P1, apdu.P2,
 		byte(len(apdu.Payload)),
 	}, apdu.Payload...)
-	if _, err := af.hf.Write(data); err != nil {
-		return nil, err
-	}
+}
+
+// maxAPDUPayload is the most a single APDU can carry; longer payloads are
+// split by NanoS.Exchange.
+const maxAPDUPayload = 255
+
+var errAPDUTooLong = errors.New("APDU payload cannot exceed 255 bytes")
 
-	// read APDU length
-	if _, err := io.ReadFull(af.hf, af.buf[:]); err != nil {
+type apduFramer struct {
+	hf *hidFramer
+}
+
+func (af *apduFramer) Exchange(ctx context.Context, apdu APDU) ([]byte, error) {
+	if len(apdu.Payload) > maxAPDUPayload {
+		return nil, errAPDUTooLong
+	}
+	if err := af.hf.writeAPDU(apdu.encode()); err != nil {
 		return nil, err
 	}
-	// read APDU payload
-	respLen := binary.BigEndian.Uint16(af.buf[:2])
-	resp := make([]byte, respLen)
-	_, err := io.ReadFull(af.hf, resp)
+	return af.hf.readAPDU(ctx)
+}
+
+func (af *apduFramer) Close() error {
+	return af.hf.Close()
+}
 
-	return resp, err
+// observePackets reports the duration of every HID report to fn (nil to
+// stop).
+func (af *apduFramer) observePackets(fn func(time.Duration)) {
+	af.hf.onPacket = fn
 }
 
+// packetObserver is implemented by transports that can time the individual
+// packets making up an exchange.
+type packetObserver interface {
+	observePackets(fn func(time.Duration))
+}
+
+// observePackets reports the duration of every transport packet to fn, and
+// returns false if the transport cannot do so.
+func (n *NanoS) observePackets(fn func(time.Duration)) bool {
+	t := n.device
+	if tt, ok := t.(*tracingTransport); ok {
+		t = tt.Transport
+	}
+	po, ok := t.(packetObserver)
+	if ok {
+		po.observePackets(fn)
+	}
+	return ok
+}
+
+// DefaultExchangeTimeout bounds a single APDU exchange. It is generous
+// because some commands wait for the user to confirm on the device.
+const DefaultExchangeTimeout = 90 * time.Second
+
+// NanoS is a handle on a Ledger running the Incognito app. It is safe for
+// concurrent use: exchanges are serialised through a queue owned by a
+// single goroutine.
 type NanoS struct {
-	device *apduFramer
+	device Transport
+	queue  *exchangeQueue // nil inside a Session
+	// reopen returns a fresh transport to the same device after it was
+	// lost; nil if the device cannot be reconnected.
+	reopen func() (Transport, error)
+	// state is shared with the copies handed to Sessions.
+	state *deviceState
+
+	// Timeout is the deadline applied to every APDU exchange; zero means
+	// no deadline.
+	Timeout time.Duration
 }
 
+// deviceState is what a NanoS learns about the app, updated atomically.
+type deviceState struct {
+	// noBatchKeyImage is set once the app turned out not to support
+	// cmdKeyImageBatch.
+	noBatchKeyImage int32
+	// activeKey is the account index last selected with SwitchKey, which
+	// Reconnect selects again; -1 if none was.
+	activeKey int64
+}
+
+// NewNanoS returns a NanoS that talks to the device through t.
+func NewNanoS(t Transport) *NanoS {
+	return &NanoS{
+		device:  t,
+		queue:   newExchangeQueue(),
+		state:   &deviceState{activeKey: -1},
+		Timeout: DefaultExchangeTimeout,
+	}
+}
+
+// Close stops the exchange queue and releases the underlying transport.
+func (n *NanoS) Close() error {
+	if n.queue != nil {
+		n.queue.close()
+	}
+	return n.device.Close()
+}
+
+// ErrCode is an APDU status word other than codeSuccess. Known codes have
+// exported values below so callers can match them with errors.Is.
 type ErrCode uint16
 
 func (c ErrCode) Error() string {
+	if text, ok := statusText[c]; ok {
+		return fmt.Sprintf("%s (0x%04x)", text, uint16(c))
+	}
 	return fmt.Sprintf("Error code 0x%x", uint16(c))
 }
 
-const codeSuccess = 0x9000
-const codeUserRejected = 0x6985
-const codeInvalidParam = 0x6b01
+const (
+	codeSuccess          = 0x9000
+	codeDeviceLocked     = 0x5515
+	codeAppNotOpen       = 0x6511
+	codeWrongLength      = 0x6700
+	codeSecurityStatus   = 0x6982
+	codeUserRejected     = 0x6985
+	codeInvalidData      = 0x6a80
+	codeWrongP1P2        = 0x6b00
+	codeInvalidParam     = 0x6b01
+	codeINSNotSupported  = 0x6d00
+	codeCLANotSupported  = 0x6e00
+	codeTechnicalProblem = 0x6f00
+	codeDeviceHalted     = 0x6faa
+)
 
-var errUserRejected = errors.New("user denied request")
-var errInvalidParam = errors.New("invalid request parameters")
+var (
+	ErrDeviceLocked     = ErrCode(codeDeviceLocked)
+	ErrAppNotOpen       = ErrCode(codeAppNotOpen)
+	ErrWrongLength      = ErrCode(codeWrongLength)
+	ErrSecurityStatus   = ErrCode(codeSecurityStatus)
+	ErrUserRejected     = ErrCode(codeUserRejected)
+	ErrInvalidData      = ErrCode(codeInvalidData)
+	ErrWrongP1P2        = ErrCode(codeWrongP1P2)
+	ErrInvalidParam     = ErrCode(codeInvalidParam)
+	ErrINSNotSupported  = ErrCode(codeINSNotSupported)
+	ErrCLANotSupported  = ErrCode(codeCLANotSupported)
+	ErrTechnicalProblem = ErrCode(codeTechnicalProblem)
+	ErrDeviceHalted     = ErrCode(codeDeviceHalted)
+)
 
+var statusText = map[ErrCode]string{
+	ErrDeviceLocked:     "device is locked",
+	ErrAppNotOpen:       "Incognito app is not open",
+	ErrWrongLength:      "wrong APDU length",
+	ErrSecurityStatus:   "security status not satisfied (is the device locked?)",
+	ErrUserRejected:     "user denied request",
+	ErrInvalidData:      "invalid data",
+	ErrWrongP1P2:        "invalid P1/P2",
+	ErrInvalidParam:     "invalid request parameters",
+	ErrINSNotSupported:  "instruction not supported (wrong app or outdated app version?)",
+	ErrCLANotSupported:  "class not supported (is the Incognito app open?)",
+	ErrTechnicalProblem: "technical problem on the device",
+	ErrDeviceHalted:     "device halted, please reconnect it",
+}
+
+// IsStatusError reports whether err is a status word returned by the
+// device, as opposed to a failure to talk to it.
+func IsStatusError(err error) bool {
+	var code ErrCode
+	return errors.As(err, &code)
+}
+
+// Exchange sends data to the device as one or more APDUs and returns the
+// response to the last one. Payloads longer than maxAPDUPayload are streamed
+// in chunks: the first carries p1 (p1First for plain commands), the rest
+// carry p1|p1More, and every chunk but the last must be acknowledged with an
+// empty success response.
 func (n *NanoS) Exchange(cmd byte, p1, p2 byte, data []byte) (resp []byte, err error) {
-	resp, err = n.device.Exchange(APDU{
+	return n.ExchangeContext(context.Background(), cmd, p1, p2, data)
+}
+
+// ExchangeContext is like Exchange but gives up when ctx is done. Each APDU
+// is additionally bounded by n.Timeout. The exchange waits its turn in the
+// device queue at the priority carried by ctx (see WithPriority).
+func (n *NanoS) ExchangeContext(ctx context.Context, cmd byte, p1, p2 byte, data []byte) (resp []byte, err error) {
+	if n.queue != nil {
+		if qerr := n.queue.do(ctx, func() {
+			resp, err = n.exchangeChunks(ctx, cmd, p1, p2, data)
+		}); qerr != nil {
+			return nil, qerr
+		}
+		return
+	}
+	return n.exchangeChunks(ctx, cmd, p1, p2, data)
+}
+
+func (n *NanoS) exchangeChunks(ctx context.Context, cmd byte, p1, p2 byte, data []byte) (resp []byte, err error) {
+	chunkP1 := p1 | p1First
+	for {
+		chunk := data
+		if len(chunk) > maxAPDUPayload {
+			chunk = chunk[:maxAPDUPayload]
+		}
+		data = data[len(chunk):]
+		resp, err = n.exchange(ctx, cmd, chunkP1, p2, chunk)
+		if err != nil {
+			return nil, err
+		} else if len(data) == 0 {
+			return resp, nil
+		} else if len(resp) != 0 {
+			return nil, errors.New("device answered before the last APDU chunk")
+		}
+		chunkP1 = p1 | p1More
+	}
+}
+
+func (n *NanoS) exchange(ctx context.Context, cmd byte, p1, p2 byte, data []byte) (resp []byte, err error) {
+	if n.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.Timeout)
+		defer cancel()
+	}
+	resp, err = n.device.Exchange(ctx, APDU{
 		CLA:     cla,
 		INS:     cmd,
 		P1:      p1,
@@ -169,20 +560,9 @@ func (n *NanoS) Exchange(cmd byte, p1, p2 byte, data []byte) (resp []byte, err e
 	} else if len(resp) < 2 {
 		return nil, errors.New("APDU response missing status code")
 	}
-	if len(resp) == 2 {
-		return resp, nil
-	}
-	// code := binary.BigEndian.Uint16(resp[len(resp)-2:])
-	resp = resp[0 : len(resp)-2]
-	// switch code {
-	// case codeSuccess:
-	// 	err = nil
-	// case codeUserRejected:
-	// 	err = errUserRejected
-	// case codeInvalidParam:
-	// 	err = errInvalidParam
-	// default:
-	// 	err = ErrCode(code)
-	// }z
-	return
+	code := binary.BigEndian.Uint16(resp[len(resp)-2:])
+	if code != codeSuccess {
+		return nil, ErrCode(code)
+	}
+	return resp[:len(resp)-2], nil
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHID hands out the reports sent on its channel, one per Read, and
+// notes whether it was closed while a Read was blocked.
+type fakeHID struct {
+	reports chan []byte
+
+	mu                 sync.Mutex
+	reading            bool
+	closed             bool
+	closedWhileReading bool
+}
+
+func newFakeHID() *fakeHID {
+	return &fakeHID{reports: make(chan []byte, 16)}
+}
+
+func (f *fakeHID) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	f.reading = true
+	f.mu.Unlock()
+	r, ok := <-f.reports
+	f.mu.Lock()
+	f.reading = false
+	f.mu.Unlock()
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, r), nil
+}
+
+func (f *fakeHID) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (f *fakeHID) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reading {
+		f.closedWhileReading = true
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *fakeHID) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// hidReport builds a report of the given channel and sequence number.
+func hidReport(channel, seq uint16, data []byte) []byte {
+	r := make([]byte, hidPacketSize)
+	binary.BigEndian.PutUint16(r[:2], channel)
+	r[2] = hidTagAPDU
+	binary.BigEndian.PutUint16(r[3:5], seq)
+	copy(r[5:], data)
+	return r
+}
+
+func TestHIDReadAPDUResync(t *testing.T) {
+	dev := newFakeHID()
+	hf := &hidFramer{rw: dev}
+	defer hf.Close()
+
+	// 70 bytes take a first report and one continuation
+	want := bytes.Repeat([]byte{0xab}, 70)
+	first := append([]byte{0, byte(len(want))}, want[:hidPacketSize-7]...)
+	// left over from an abandoned exchange, and another channel
+	dev.reports <- hidReport(hidChannel, 1, bytes.Repeat([]byte{0xff}, 59))
+	dev.reports <- hidReport(0x0202, 0, []byte{0, 2, 0xee, 0xee})
+	dev.reports <- hidReport(hidChannel, 0, first)
+	dev.reports <- hidReport(hidChannel, 1, want[hidPacketSize-7:])
+
+	got, err := hf.readAPDU(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestHIDShortRead(t *testing.T) {
+	dev := newFakeHID()
+	hf := &hidFramer{rw: dev}
+	defer hf.Close()
+
+	dev.reports <- []byte{0x01, 0x01, hidTagAPDU}
+	if _, err := hf.readAPDU(context.Background()); err == nil {
+		t.Fatal("short report accepted")
+	}
+}
+
+func TestHIDReadDeadline(t *testing.T) {
+	dev := newFakeHID()
+	hf := &hidFramer{rw: dev}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := hf.readPacket(ctx); !errors.Is(err, ErrDeviceTimeout) {
+		t.Fatalf("got %v, want %v", err, ErrDeviceTimeout)
+	}
+	// the read is still pending, so the handle must stay open
+	if dev.isClosed() {
+		t.Fatal("handle closed during a pending read")
+	}
+	if _, err := hf.readPacket(context.Background()); !errors.Is(err, ErrDeviceDisconnected) {
+		t.Fatalf("read after timeout: got %v, want %v", err, ErrDeviceDisconnected)
+	}
+	// the abandoned read releases the handle once it returns
+	dev.reports <- hidReport(hidChannel, 0, nil)
+	waitClosed(t, dev)
+}
+
+func TestHIDCloseDuringRead(t *testing.T) {
+	dev := newFakeHID()
+	hf := &hidFramer{rw: dev}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := hf.readPacket(context.Background())
+		errc <- err
+	}()
+	for {
+		dev.mu.Lock()
+		reading := dev.reading
+		dev.mu.Unlock()
+		if reading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := hf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.isClosed() {
+		t.Fatal("Close closed the handle during a pending read")
+	}
+	dev.reports <- hidReport(hidChannel, 0, nil)
+	<-errc
+	waitClosed(t, dev)
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.closedWhileReading {
+		t.Fatal("handle closed while a read was blocked on it")
+	}
+}
+
+func waitClosed(t *testing.T, dev *fakeHID) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if dev.isClosed() {
+			return
+		}
+	}
+	t.Fatal("handle never closed")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// progressBar draws a single-line progress bar with an ETA, redrawn in
+// place on every update.
+type progressBar struct {
+	w     io.Writer
+	label string
+	total int
+	done  int
+	start time.Time
+}
+
+func newProgressBar(w io.Writer, label string, total int) *progressBar {
+	p := &progressBar{
+		w:     w,
+		label: label,
+		total: total,
+		start: time.Now(),
+	}
+	p.draw()
+	return p
+}
+
+// Add records n more finished items.
+func (p *progressBar) Add(n int) {
+	p.done += n
+	p.draw()
+}
+
+// Finish ends the line the bar is drawn on.
+func (p *progressBar) Finish() {
+	fmt.Fprintln(p.w)
+}
+
+func (p *progressBar) draw() {
+	filled := progressBarWidth
+	if p.total > 0 {
+		filled = progressBarWidth * p.done / p.total
+	}
+	eta := "--"
+	if p.done > 0 && p.done < p.total {
+		elapsed := time.Since(p.start)
+		remaining := elapsed * time.Duration(p.total-p.done) / time.Duration(p.done)
+		eta = remaining.Round(time.Second).String()
+	} else if p.done >= p.total {
+		eta = "done"
+	}
+	fmt.Fprintf(p.w, "\r%s [%s%s] %d/%d ETA %s   ", p.label,
+		strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled),
+		p.done, p.total, eta)
+}
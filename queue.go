@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Priority orders requests waiting for the device. Interactive signing
+// should use PriorityHigh so it is not stuck behind background work.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose device exchanges are queued at p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= PriorityLow && p < numPriorities {
+		return p
+	}
+	return PriorityNormal
+}
+
+var errDeviceClosed = errors.New("device closed")
+
+// exchangeQueue hands the device to one job at a time. A single owner
+// goroutine runs the jobs, highest priority first and in submission order
+// within a priority; a job whose context ends before it starts is dropped.
+type exchangeQueue struct {
+	mu      sync.Mutex
+	pending [numPriorities][]*queuedJob
+	closed  bool
+
+	wake chan struct{}
+	quit chan struct{}
+}
+
+type queuedJob struct {
+	run       func()
+	started   bool
+	cancelled bool
+	// err is set instead of running the job if the queue was closed
+	err  error
+	done chan struct{}
+}
+
+func newExchangeQueue() *exchangeQueue {
+	q := &exchangeQueue{
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+	go q.serve()
+	return q
+}
+
+func (q *exchangeQueue) serve() {
+	for {
+		select {
+		case <-q.quit:
+			q.failPending()
+			return
+		default:
+		}
+		if job := q.pop(); job != nil {
+			job.run()
+			close(job.done)
+			continue
+		}
+		select {
+		case <-q.wake:
+		case <-q.quit:
+			q.failPending()
+			return
+		}
+	}
+}
+
+// failPending ends the jobs still queued when the queue is closed.
+func (q *exchangeQueue) failPending() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := range q.pending {
+		for _, job := range q.pending[p] {
+			if !job.cancelled {
+				job.started = true
+				job.err = errDeviceClosed
+				close(job.done)
+			}
+		}
+		q.pending[p] = nil
+	}
+}
+
+func (q *exchangeQueue) pop() *queuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := numPriorities - 1; p >= PriorityLow; p-- {
+		for len(q.pending[p]) > 0 {
+			job := q.pending[p][0]
+			q.pending[p] = q.pending[p][1:]
+			if !job.cancelled {
+				job.started = true
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// do runs fn on the owner goroutine and waits for it. If ctx ends while fn
+// is still queued, fn is skipped and ctx.Err() returned; once started, fn is
+// expected to observe ctx itself.
+func (q *exchangeQueue) do(ctx context.Context, fn func()) error {
+	job := &queuedJob{
+		run:  fn,
+		done: make(chan struct{}),
+	}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errDeviceClosed
+	}
+	p := priorityFrom(ctx)
+	q.pending[p] = append(q.pending[p], job)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-job.done:
+		return job.err
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	if !job.started {
+		job.cancelled = true
+		q.mu.Unlock()
+		return ctx.Err()
+	}
+	q.mu.Unlock()
+	<-job.done
+	return job.err
+}
+
+func (q *exchangeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.quit)
+	}
+}
+
+// Session gives fn exclusive use of the device, for command sequences that
+// must not be interleaved with other callers (such as the ring signature
+// steps). fn must use the NanoS it is handed, not n. The session is queued
+// at the priority carried by ctx.
+func (n *NanoS) Session(ctx context.Context, fn func(dev *NanoS) error) error {
+	if n.queue == nil {
+		return fn(n)
+	}
+	var err error
+	qerr := n.queue.do(ctx, func() {
+		// copy n on the owner goroutine, which is the one that swaps its
+		// transport on reconnect
+		dev := *n
+		dev.queue = nil
+		err = fn(&dev)
+	})
+	if qerr != nil {
+		return qerr
+	}
+	return err
+}
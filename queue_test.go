@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var swOK = []byte{0x90, 0x00}
+
+// blockingDevice returns a device whose cmdGetVersion exchanges signal
+// busy and wait for release, and which logs the instruction of every APDU
+// it answers.
+func blockingDevice(release <-chan struct{}) (*NanoS, <-chan struct{}, func() []byte) {
+	var mu sync.Mutex
+	var log []byte
+	busy := make(chan struct{}, 1)
+	n := NewNanoS(TransportFunc(func(ctx context.Context, apdu APDU) ([]byte, error) {
+		if apdu.INS == cmdGetVersion {
+			busy <- struct{}{}
+			<-release
+		}
+		mu.Lock()
+		log = append(log, apdu.INS)
+		mu.Unlock()
+		return swOK, nil
+	}))
+	return n, busy, func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]byte(nil), log...)
+	}
+}
+
+// waitQueued waits until q holds n jobs that haven't started.
+func waitQueued(t *testing.T, q *exchangeQueue, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		queued := 0
+		for _, jobs := range q.pending {
+			queued += len(jobs)
+		}
+		q.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("%d jobs never got queued", n)
+}
+
+func TestQueuePriority(t *testing.T) {
+	release := make(chan struct{})
+	nanos, busy, sent := blockingDevice(release)
+	defer nanos.Close()
+
+	var wg sync.WaitGroup
+	exchange := func(p Priority, ins byte) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := nanos.ExchangeContext(WithPriority(context.Background(), p), ins, 0, 0, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// hold the device, then queue one exchange per priority
+	exchange(PriorityNormal, cmdGetVersion)
+	<-busy
+	exchange(PriorityLow, cmdKeyImage)
+	waitQueued(t, nanos.queue, 1)
+	exchange(PriorityNormal, cmdGetAddress)
+	waitQueued(t, nanos.queue, 2)
+	exchange(PriorityHigh, cmdSignSchnorr)
+	waitQueued(t, nanos.queue, 3)
+	close(release)
+	wg.Wait()
+
+	want := []byte{cmdGetVersion, cmdSignSchnorr, cmdGetAddress, cmdKeyImage}
+	if got := sent(); string(got) != string(want) {
+		t.Fatalf("device got %x, want %x", got, want)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	release := make(chan struct{})
+	nanos, busy, sent := blockingDevice(release)
+	defer nanos.Close()
+
+	go nanos.Exchange(cmdGetVersion, 0, 0, nil)
+	<-busy
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := nanos.ExchangeContext(ctx, cmdKeyImage, 0, 0, nil)
+		errc <- err
+	}()
+	waitQueued(t, nanos.queue, 1)
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled exchange returned %v", err)
+	}
+	close(release)
+	if _, err := nanos.Exchange(cmdGetAddress, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{cmdGetVersion, cmdGetAddress}
+	if got := sent(); string(got) != string(want) {
+		t.Fatalf("device got %x, want %x", got, want)
+	}
+}
+
+func TestQueueSerialises(t *testing.T) {
+	var inFlight, overlaps int32
+	var mu sync.Mutex
+	var sent []byte
+	nanos := NewNanoS(TransportFunc(func(ctx context.Context, apdu APDU) ([]byte, error) {
+		if atomic.AddInt32(&inFlight, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(100 * time.Microsecond)
+		mu.Lock()
+		sent = append(sent, apdu.INS)
+		mu.Unlock()
+		atomic.AddInt32(&inFlight, -1)
+		return swOK, nil
+	}))
+	defer nanos.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nanos.Exchange(cmdGetAddress, 0, 0, nil)
+		}()
+	}
+	// a session's exchanges are not interleaved with the others
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := nanos.Session(context.Background(), func(dev *NanoS) error {
+			for i := 0; i < 5; i++ {
+				if _, err := dev.Exchange(cmdCalculateR, 0, 0, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	if overlaps > 0 {
+		t.Fatalf("%d exchanges overlapped", overlaps)
+	}
+	last := -1
+	for i, ins := range sent {
+		if ins != cmdCalculateR {
+			continue
+		} else if last >= 0 && i != last+1 {
+			t.Fatalf("session interleaved with other exchanges: %x", sent)
+		}
+		last = i
+	}
+}
+
+func TestQueueCloseFailsPending(t *testing.T) {
+	q := newExchangeQueue()
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	go q.do(context.Background(), func() {
+		close(busy)
+		<-release
+	})
+	<-busy
+	errc := make(chan error, 1)
+	go func() {
+		errc <- q.do(context.Background(), func() { t.Error("job ran after close") })
+	}()
+	waitQueued(t, q, 1)
+	q.close()
+	close(release)
+	select {
+	case err := <-errc:
+		if err != errDeviceClosed {
+			t.Fatalf("queued job returned %v, want %v", err, errDeviceClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued job still waiting after close")
+	}
+}
+
+func TestSessionSwitchKey(t *testing.T) {
+	nanos := NewNanoS(TransportFunc(func(ctx context.Context, apdu APDU) ([]byte, error) {
+		return swOK, nil
+	}))
+	defer nanos.Close()
+
+	err := nanos.Session(context.Background(), func(dev *NanoS) error {
+		return dev.SwitchKey(3)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reconnect restores the key selected inside the session
+	if index := atomic.LoadInt64(&nanos.state.activeKey); index != 3 {
+		t.Fatalf("active key %d, want 3", index)
+	}
+}
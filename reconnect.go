@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// reconnectTimeout is how long a signing session waits for a lost
+	// device to come back.
+	reconnectTimeout = 5 * time.Minute
+	// reconnectPollInterval is how often Reconnect looks for the device.
+	reconnectPollInterval = time.Second
+)
+
+var errCannotReconnect = errors.New("device cannot be reconnected")
+
+// IsDeviceLost reports whether err means the device went away or can no
+// longer serve requests until the user acts on it: unplugged, timed out,
+// locked, or the Incognito app closed.
+func IsDeviceLost(err error) bool {
+	for _, lost := range []error{
+		ErrDeviceDisconnected,
+		ErrDeviceTimeout,
+		ErrDeviceLocked,
+		ErrSecurityStatus,
+		ErrAppNotOpen,
+		ErrCLANotSupported,
+		ErrDeviceHalted,
+	} {
+		if errors.Is(err, lost) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reconnect waits until the device is reachable again with the Incognito
+// app open, then re-runs TrustHost and SwitchKey. Any state the app held (such as ring
+// signature alphas) is gone, so callers have to restart what they were
+// doing. It must not be called from inside a Session.
+func (n *NanoS) Reconnect(ctx context.Context) error {
+	if n.reopen == nil || n.queue == nil {
+		return errCannotReconnect
+	}
+	log.Println("Waiting for the device, please plug it in, unlock it and open the Incognito app...")
+	var err error
+	qerr := n.queue.do(ctx, func() {
+		for {
+			if err = n.tryReconnect(); err == nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-time.After(reconnectPollInterval):
+			}
+		}
+	})
+	if qerr != nil {
+		return qerr
+	}
+	return err
+}
+
+// tryReconnect makes one attempt at reopening the device. It runs on the
+// queue's owner goroutine, so it can swap the transport safely.
+func (n *NanoS) tryReconnect() error {
+	t, err := n.reopen()
+	if err != nil {
+		return err
+	}
+	n.setTransport(t)
+
+	dev := *n
+	dev.queue = nil
+	if _, err := dev.GetVersion(); err != nil {
+		return err
+	}
+	if err := dev.TrustHost(); err != nil {
+		return err
+	}
+	// the app starts on account 0, so sign with the right key again
+	if index := atomic.LoadInt64(&n.state.activeKey); index >= 0 {
+		if err := dev.SwitchKey(uint32(index)); err != nil {
+			return err
+		}
+	}
+	log.Println("Device reconnected")
+	return nil
+}
+
+// setTransport replaces the transport, keeping any trace recording in place.
+func (n *NanoS) setTransport(t Transport) {
+	if tt, ok := n.device.(*tracingTransport); ok {
+		tt.Transport.Close()
+		tt.Transport = t
+		return
+	}
+	n.device.Close()
+	n.device = t
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// insNames gives the name of every instruction in const.go, for traces.
+var insNames = map[byte]string{
+	cmdGetVersion:        "GetVersion",
+	cmdGetAddress:        "GetAddress",
+	cmdGetViewKey:        "GetViewKey",
+	cmdGetPrivateKey:     "GetPrivateKey",
+	cmdSwitchKey:         "SwitchKey",
+	cmdGetOTAKey:         "GetOTAKey",
+	cmdGetValidatorKey:   "GetValidatorKey",
+	cmdKeyImage:          "KeyImage",
+	cmdKeyImageBatch:     "KeyImageBatch",
+	cmdGenAlpha:          "GenAlpha",
+	cmdCalculateC:        "CalculateC",
+	cmdCalculateR:        "CalculateR",
+	cmdGenCoinPrivateKey: "GenCoinPrivateKey",
+	cmdSignSchnorr:       "SignSchnorr",
+	cmdSignHash:          "SignHash",
+	cmdTrustHost:         "TrustHost",
+}
+
+func insName(ins byte) string {
+	if name, ok := insNames[ins]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", ins)
+}
+
+// Instructions whose request payload or response carries secrets. With
+// redaction on, those bytes are zeroed in the trace (lengths are kept).
+var (
+	secretRequests = map[byte]bool{
+		cmdKeyImage:          true,
+		cmdKeyImageBatch:     true,
+		cmdGenCoinPrivateKey: true,
+		cmdSignSchnorr:       true,
+	}
+	secretResponses = map[byte]bool{
+		cmdGetPrivateKey:   true,
+		cmdGetViewKey:      true,
+		cmdGetOTAKey:       true,
+		cmdGetValidatorKey: true,
+	}
+)
+
+// TraceEntry is one recorded APDU exchange. Request and Response are hex,
+// the response including its status word.
+type TraceEntry struct {
+	Time     time.Time
+	INS      string
+	Request  string
+	Response string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Redacted bool   `json:",omitempty"`
+}
+
+// tracingTransport records every exchange of the wrapped Transport as one
+// JSON TraceEntry per line.
+type tracingTransport struct {
+	Transport
+	mu     sync.Mutex
+	enc    *json.Encoder
+	redact bool
+}
+
+// Record makes n log every APDU it exchanges to w. If redact is set, secret
+// payloads and responses are zeroed out.
+func (n *NanoS) Record(w io.Writer, redact bool) {
+	n.device = &tracingTransport{
+		Transport: n.device,
+		enc:       json.NewEncoder(w),
+		redact:    redact,
+	}
+}
+
+func (t *tracingTransport) Exchange(ctx context.Context, apdu APDU) ([]byte, error) {
+	start := time.Now()
+	resp, err := t.Transport.Exchange(ctx, apdu)
+
+	req := apdu.encode()
+	entry := TraceEntry{
+		Time: start,
+		INS:  insName(apdu.INS),
+	}
+	if t.redact && secretRequests[apdu.INS] {
+		req = redacted(req, 5, len(req))
+		entry.Redacted = true
+	}
+	if resp != nil {
+		out := resp
+		if t.redact && secretResponses[apdu.INS] && len(resp) > 2 {
+			out = redacted(resp, 0, len(resp)-2)
+			entry.Redacted = true
+		}
+		entry.Response = hex.EncodeToString(out)
+	}
+	entry.Request = hex.EncodeToString(req)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if encErr := t.enc.Encode(entry); encErr != nil && err == nil {
+		err = fmt.Errorf("writing trace: %v", encErr)
+	}
+	return resp, err
+}
+
+// redacted returns a copy of b with b[from:to] zeroed.
+func redacted(b []byte, from, to int) []byte {
+	c := append([]byte(nil), b...)
+	for i := from; i < to; i++ {
+		c[i] = 0
+	}
+	return c
+}
+
+// replayTransport answers APDUs from a recorded trace, in order. Each
+// request must match the recorded one; redacted requests are matched on
+// their header only.
+type replayTransport struct {
+	mu      sync.Mutex
+	entries []TraceEntry
+	next    int
+}
+
+// OpenReplay returns a NanoS that replays the trace stored in path.
+func OpenReplay(path string) (*NanoS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := NewReplayTransport(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewNanoS(t), nil
+}
+
+// NewReplayTransport reads a trace written by NanoS.Record.
+func NewReplayTransport(r io.Reader) (Transport, error) {
+	t := new(replayTransport)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry TraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("trace entry %d: %v", len(t.entries)+1, err)
+		}
+		t.entries = append(t.entries, entry)
+	}
+	return t, scanner.Err()
+}
+
+func (t *replayTransport) Exchange(ctx context.Context, apdu APDU) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.next == len(t.entries) {
+		return nil, errors.New("replay: trace exhausted")
+	}
+	entry := t.entries[t.next]
+	t.next++
+
+	recorded, err := hex.DecodeString(entry.Request)
+	if err != nil {
+		return nil, fmt.Errorf("replay: entry %d: %v", t.next, err)
+	}
+	req := apdu.encode()
+	if entry.Redacted && secretRequests[apdu.INS] {
+		if len(recorded) != len(req) || !bytes.Equal(recorded[:5], req[:5]) {
+			return nil, fmt.Errorf("replay: entry %d: request does not match recorded %s", t.next, entry.INS)
+		}
+	} else if !bytes.Equal(recorded, req) {
+		return nil, fmt.Errorf("replay: entry %d: request does not match recorded %s", t.next, entry.INS)
+	}
+
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+	return hex.DecodeString(entry.Response)
+}
+
+func (t *replayTransport) Close() error {
+	return nil
+}
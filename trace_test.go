@@ -0,0 +1,165 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/incognitochain/incognito-chain/common"
+)
+
+func newReplayDevice(t *testing.T, trace []byte) *NanoS {
+	t.Helper()
+	replay, err := NewReplayTransport(bytes.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewNanoS(replay)
+}
+
+func TestRecordReplay(t *testing.T) {
+	var trace bytes.Buffer
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+	nanos.Record(&trace, false)
+
+	coin := randomCoin()
+	hash := common.HashH([]byte("trace test")).Bytes()
+	addr, err := nanos.GetAddress(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ki, err := nanos.GenKeyImage(coin.CoinPubkey, coin.EncryptKm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := nanos.SignHash(0, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay := newReplayDevice(t, trace.Bytes())
+	defer replay.Close()
+	if got, err := replay.GetAddress(0); err != nil {
+		t.Fatal(err)
+	} else if got != addr {
+		t.Fatalf("replayed address %s, want %s", got, addr)
+	}
+	if got, err := replay.GenKeyImage(coin.CoinPubkey, coin.EncryptKm); err != nil {
+		t.Fatal(err)
+	} else if got != ki {
+		t.Fatalf("replayed key image %s, want %s", got, ki)
+	}
+	other := common.HashH([]byte("another hash")).Bytes()
+	if _, err := replay.SignHash(0, other); err == nil {
+		t.Fatal("replay answered a request that differs from the recorded one")
+	}
+
+	replay = newReplayDevice(t, trace.Bytes())
+	defer replay.Close()
+	replay.GetAddress(0)
+	replay.GenKeyImage(coin.CoinPubkey, coin.EncryptKm)
+	if got, err := replay.SignHash(0, hash); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, sig) {
+		t.Fatal("replayed signature differs from the recorded one")
+	}
+	if _, err := replay.GetAddress(0); err == nil {
+		t.Fatal("replay answered past the end of the trace")
+	}
+}
+
+func TestRecordReplayRedacted(t *testing.T) {
+	var trace bytes.Buffer
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+	nanos.Record(&trace, true)
+
+	viewKey, err := nanos.GetViewKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := randomCoin()
+	ki, err := nanos.GenKeyImage(coin.CoinPubkey, coin.EncryptKm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := trace.String(); strings.Contains(s, viewKey) {
+		t.Fatal("trace contains the view key")
+	} else if strings.Contains(s, coin.EncryptKm) {
+		t.Fatal("trace contains the encrypted km of the coin")
+	}
+
+	replay := newReplayDevice(t, trace.Bytes())
+	defer replay.Close()
+	if got, err := replay.GetViewKey(0); err != nil {
+		t.Fatal(err)
+	} else if got == viewKey {
+		t.Fatal("replayed the redacted view key")
+	}
+	// redacted requests are matched on their header, so any coin does
+	other := randomCoin()
+	if got, err := replay.GenKeyImage(other.CoinPubkey, other.EncryptKm); err != nil {
+		t.Fatal(err)
+	} else if got != ki {
+		t.Fatalf("replayed key image %s, want %s", got, ki)
+	}
+}
+
+// seededDaemon starts a mock daemon whose coins and transactions derive
+// from a fixed seed, and imports the test account into it with its key
+// images submitted.
+func seededDaemon(t *testing.T) (*MockDaemon, *CoinDaemon, func()) {
+	t.Helper()
+	restore := inTempDir(t)
+	mock := NewMockDaemon()
+	mock.CoinsPerImport = 3
+	mock.Seed = []byte("trace test")
+	daemon, srv := startMockDaemon(t, mock)
+	nanos := newTestDevice(t)
+	defer nanos.Close()
+	ctx := context.Background()
+	if err := requestImportAccount(ctx, nanos, daemon, "testacc", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestUpdateBalance(ctx, nanos, daemon, "testacc"); err != nil {
+		t.Fatal(err)
+	}
+	return mock, daemon, func() {
+		srv.Close()
+		restore()
+	}
+}
+
+func TestReplayCreateTx(t *testing.T) {
+	var trace bytes.Buffer
+	_, daemon, done := seededDaemon(t)
+	nanos := newTestDevice(t)
+	nanos.Record(&trace, false)
+	txID, err := requestCreateTx(context.Background(), nanos, daemon, writeTxFile(t, "testacc"))
+	nanos.Close()
+	done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a daemon with the same seed asks the same of the device, so the
+	// recorded negotiation can stand in for it
+	mock, daemon, done := seededDaemon(t)
+	defer done()
+	replay := newReplayDevice(t, trace.Bytes())
+	defer replay.Close()
+	got, err := requestCreateTx(context.Background(), replay, daemon, writeTxFile(t, "testacc"))
+	if err != nil {
+		t.Fatal(err)
+	} else if got != txID {
+		t.Fatalf("replayed tx %s, want %s", got, txID)
+	}
+	if txs := mock.Transactions(); len(txs) != 1 || txs[0].TxID != txID {
+		t.Fatalf("daemon recorded %+v, want tx %s", txs, txID)
+	}
+}
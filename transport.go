@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Transport exchanges raw APDUs with a Ledger device, or with anything that
+// answers like one (an emulator, a socket, a test double). NanoS only ever
+// talks to its device through this interface.
+type Transport interface {
+	// Exchange sends apdu and returns the raw reply, status word included.
+	// Implementations should give up once ctx is done.
+	Exchange(ctx context.Context, apdu APDU) ([]byte, error)
+	Close() error
+}
+
+// TransportFunc adapts an ordinary function to the Transport interface, which
+// is handy for in-memory test doubles.
+type TransportFunc func(ctx context.Context, apdu APDU) ([]byte, error)
+
+func (f TransportFunc) Exchange(ctx context.Context, apdu APDU) ([]byte, error) {
+	return f(ctx, apdu)
+}
+
+func (f TransportFunc) Close() error {
+	return nil
+}
+
+// openEmulator opens "--device emu". It is only set in builds made with
+// -tags dev (see dev.go), so release binaries never sign with a raw private
+// key.
+var openEmulator func() (*NanoS, error)
+
+// OpenDevice opens the device described by spec:
+//
+//	"" or "hid"       the first Ledger on USB
+//	"path:<path>"     the Ledger at the given HID path
+//	"serial:<serial>" the Ledger with the given serial number
+//	"emu"             the in-process Emulator (dev builds only)
+//	"tcp://host:port" the raw APDU socket of a Speculos emulator
+//	"replay:<file>"   a trace recorded with --trace-file
+//
+// The paths and serial numbers of attached Ledgers are shown by the devices
+// command.
+func OpenDevice(spec string) (*NanoS, error) {
+	switch spec {
+	case "", "hid":
+		return OpenNanoS()
+	case "emu":
+		if openEmulator == nil {
+			return nil, errors.New("the emulator is only available in builds made with -tags dev")
+		}
+		return openEmulator()
+	}
+	kind := strings.SplitN(spec, ":", 2)
+	if len(kind) != 2 {
+		return nil, fmt.Errorf("unsupported device %q", spec)
+	}
+	switch kind[0] {
+	case "path", "serial":
+		return OpenLedgerMatching(kind[0], kind[1])
+	case "tcp":
+		return OpenSpeculos(strings.TrimPrefix(kind[1], "//"))
+	case "replay":
+		return OpenReplay(kind[1])
+	default:
+		return nil, fmt.Errorf("unsupported device %q", spec)
+	}
+}
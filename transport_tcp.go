@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const tcpDialTimeout = 5 * time.Second
+
+// OpenSpeculos connects to a Speculos emulator listening on addr (usually
+// started with --apdu-port 9999).
+func OpenSpeculos(addr string) (*NanoS, error) {
+	if !strings.Contains(addr, ":") {
+		return nil, errors.New("speculos address must be host:port")
+	}
+	dial := func() (Transport, error) {
+		conn, err := net.DialTimeout("tcp", addr, tcpDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpTransport{conn: conn}, nil
+	}
+	t, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	n := NewNanoS(t)
+	n.reopen = dial
+	return n, nil
+}
+
+// tcpTransport speaks the Speculos raw APDU protocol: every command is sent
+// as a 4-byte big-endian length followed by the APDU, and every reply is a
+// 4-byte big-endian length followed by that many bytes of data plus the
+// 2-byte status word.
+type tcpTransport struct {
+	conn   net.Conn
+	buf    [4]byte
+	closed bool
+}
+
+func (t *tcpTransport) Exchange(ctx context.Context, apdu APDU) ([]byte, error) {
+	if t.closed {
+		return nil, ErrDeviceDisconnected
+	}
+	deadline, _ := ctx.Deadline()
+	if err := t.conn.SetDeadline(deadline); err != nil {
+		return nil, t.fail(ctx, err)
+	}
+	// unblock pending I/O if ctx is cancelled before its deadline; wait for
+	// the watcher to exit so it can't cut short the next exchange
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			t.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	data := apdu.encode()
+	msg := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(msg[:4], uint32(len(data)))
+	copy(msg[4:], data)
+	if _, err := t.conn.Write(msg); err != nil {
+		return nil, t.fail(ctx, err)
+	}
+
+	// read reply length (status word not included)
+	if _, err := io.ReadFull(t.conn, t.buf[:]); err != nil {
+		return nil, t.fail(ctx, err)
+	}
+	respLen := binary.BigEndian.Uint32(t.buf[:])
+	resp := make([]byte, respLen+2)
+	if _, err := io.ReadFull(t.conn, resp); err != nil {
+		return nil, t.fail(ctx, err)
+	}
+	return resp, nil
+}
+
+// fail closes the connection after an I/O error, as a reply may still be in
+// flight and would be taken for the answer to the next command, and maps
+// err to ErrDeviceTimeout or ErrDeviceDisconnected.
+func (t *tcpTransport) fail(ctx context.Context, err error) error {
+	t.Close()
+	switch {
+	case ctx.Err() == context.Canceled:
+		return ctx.Err()
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", ErrDeviceTimeout, err)
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return fmt.Errorf("%w: %v", ErrDeviceTimeout, err)
+	}
+	return fmt.Errorf("%w: %v", ErrDeviceDisconnected, err)
+}
+
+func (t *tcpTransport) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	return t.conn.Close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveSpeculos answers every APDU on l with its payload and codeSuccess,
+// the way Speculos frames replies.
+func serveSpeculos(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		apdu := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(conn, apdu); err != nil {
+			return
+		}
+		payload := apdu[5:]
+		reply := make([]byte, 4, 4+len(payload)+2)
+		binary.BigEndian.PutUint32(reply, uint32(len(payload)))
+		reply = append(reply, payload...)
+		reply = append(reply, byte(codeSuccess>>8), byte(codeSuccess&0xff))
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestSpeculosCancelAfterExchange(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveSpeculos(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &tcpTransport{conn: conn}
+	defer tr.Close()
+
+	// cancelling the context of an exchange that has returned must not
+	// disturb the next one
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		payload := []byte{byte(i)}
+		resp, err := tr.Exchange(ctx, APDU{CLA: 0xe0, INS: cmdGetVersion, Payload: payload})
+		cancel()
+		if err != nil {
+			t.Fatalf("exchange %d: %v", i, err)
+		} else if !bytes.Equal(resp[:len(resp)-2], payload) {
+			t.Fatalf("exchange %d: got %x", i, resp)
+		}
+	}
+}
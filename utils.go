@@ -1,27 +1,70 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
 	"math"
 	"strconv"
 
+	"github.com/incognitochain/incognito-chain/privacy"
 	"github.com/incognitochain/incognito-chain/privacy/operation"
+	"github.com/incognitochain/incognito-chain/wallet"
 )
 
 func GetShardIDFromLastByte(b byte) byte {
 	return byte(int(b) % 8)
 }
 
-func parseIndex(s string) uint32 {
-	index, err := strconv.ParseUint(s, 10, 32)
-	if err != nil {
-		log.Fatalln("Couldn't parse index:", err)
-	} else if index > math.MaxUint32 {
-		log.Fatalf("Index too large (max %v)", math.MaxUint32)
+// indexFlag adds the -index flag of the commands that act on one account.
+func indexFlag(fs *flag.FlagSet) *uint {
+	return fs.Uint("index", 0, "account index on the device")
+}
+
+// flagIndex checks that an -index value fits an account index.
+func flagIndex(index uint) uint32 {
+	if uint64(index) > math.MaxUint32 {
+		log.Fatalf("Index too large (max %v)", uint32(math.MaxUint32))
 	}
 	return uint32(index)
 }
 
+// accountIndex returns the account index of a key command, given either
+// with -index or as the only argument. It reports false if both are given
+// or there are other arguments.
+func accountIndex(fs *flag.FlagSet, index *uint, args []string) (uint32, bool) {
+	if len(args) == 0 {
+		return flagIndex(*index), true
+	}
+	indexSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "index" {
+			indexSet = true
+		}
+	})
+	if len(args) > 1 || indexSet {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// fatal exits with err, telling a request the user rejected on the device
+// apart from other device errors and plain failures.
+func fatal(err error) {
+	switch {
+	case errors.Is(err, ErrUserRejected):
+		log.Fatalln("Request rejected on the device")
+	case IsStatusError(err):
+		log.Fatalln("Device error:", err)
+	default:
+		log.Fatalln(err)
+	}
+}
+
 func byteArrayToScalarArray(bytes []byte) []*operation.Scalar {
 	var result []*operation.Scalar
 	maxlen := len(bytes) / 32
@@ -32,3 +75,24 @@ func byteArrayToScalarArray(bytes []byte) []*operation.Scalar {
 	}
 	return result
 }
+
+// verifyHashSignature checks a signature produced by SignHash against the
+// public key of the given payment address.
+func verifyHashSignature(paymentAddress string, hash, sig []byte) (bool, error) {
+	kw, err := wallet.Base58CheckDeserialize(paymentAddress)
+	if err != nil {
+		return false, err
+	}
+	pk, err := new(privacy.Point).FromBytesS(kw.KeySet.PaymentAddress.Pk)
+	if err != nil {
+		return false, err
+	}
+	verifyKey := new(privacy.SchnorrPublicKey)
+	verifyKey.Set(pk)
+
+	signature := new(privacy.SchnSignature)
+	if err := signature.SetBytes(sig); err != nil {
+		return false, err
+	}
+	return verifyKey.Verify(signature, hash), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// inTempDir runs the test in a temporary directory, as the CLI keeps
+// accounts.json and its checkpoints in the working directory. The returned
+// function restores the working directory.
+func inTempDir(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "incognitoledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAccountIndex(t *testing.T) {
+	tests := []struct {
+		args  []string
+		index uint32
+		ok    bool
+	}{
+		{nil, 0, true},
+		{[]string{"3"}, 3, true},
+		{[]string{"-index", "5"}, 5, true},
+		{[]string{"-index", "5", "3"}, 0, false},
+		{[]string{"3", "4"}, 0, false},
+		{[]string{"three"}, 0, false},
+		{[]string{"4294967296"}, 0, false},
+	}
+	for _, test := range tests {
+		fs := flag.NewFlagSet("addr", flag.ContinueOnError)
+		index := indexFlag(fs)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := accountIndex(fs, index, fs.Args())
+		if ok != test.ok || got != test.index {
+			t.Errorf("%q: got %d, %v; want %d, %v", test.args, got, ok, test.index, test.ok)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/incognitochain/incognito-chain/common"
+	"github.com/incognitochain/incognito-chain/common/base58"
+	"github.com/incognitochain/incognito-chain/incognitokey"
+	"github.com/incognitochain/incognito-chain/wallet"
+)
+
+// ValidatorKeys is the key material an Incognito node needs to validate
+// for an account, all base58 encoded.
+type ValidatorKeys struct {
+	// ValidatorKey is the mining key seed, passed to the node as
+	// --miningkeys.
+	ValidatorKey    string
+	BLSPublicKey    string
+	BridgePublicKey string
+	// CommitteePublicKey identifies the node in committees and is used
+	// when staking.
+	CommitteePublicKey string
+}
+
+// deriveValidatorKeys expands the mining key seed returned by the device
+// into the public keys of the account whose payment address is given.
+func deriveValidatorKeys(seed []byte, paymentAddress string) (*ValidatorKeys, error) {
+	if len(seed) == 0 {
+		return nil, errors.New("device returned an empty validator key")
+	}
+	kw, err := wallet.Base58CheckDeserialize(paymentAddress)
+	if err != nil {
+		return nil, err
+	}
+	miningKey, err := incognitokey.NewMiningKeyFromSeed(seed)
+	if err != nil {
+		return nil, err
+	}
+	committeeKey, err := incognitokey.NewCommitteeKeyFromSeed(seed, kw.KeySet.PaymentAddress.Pk)
+	if err != nil {
+		return nil, err
+	}
+	committeeKeyStr, err := committeeKey.ToBase58()
+	if err != nil {
+		return nil, err
+	}
+	b58 := base58.Base58Check{}
+	return &ValidatorKeys{
+		ValidatorKey:       b58.Encode(seed, common.ZeroByte),
+		BLSPublicKey:       b58.Encode(miningKey.PubKey[common.BlsConsensus], common.ZeroByte),
+		BridgePublicKey:    b58.Encode(miningKey.PubKey[common.BridgeConsensus], common.ZeroByte),
+		CommitteePublicKey: committeeKeyStr,
+	}, nil
+}
+
+// writeNodeConfig writes a config file snippet that makes an Incognito
+// node validate with keys. It holds the validator key, so it is only
+// readable by the owner.
+func writeNodeConfig(path string, keys *ValidatorKeys) error {
+	snippet := fmt.Sprintf(`; generated by incognitoledger getvalidator
+; committee public key: %s
+miningkeys=%s
+`, keys.CommitteePublicKey, keys.ValidatorKey)
+	return ioutil.WriteFile(path, []byte(snippet), 0600)
+}
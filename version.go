@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed major.minor.patch version.
+type semver [3]int
+
+func parseSemver(s string) (semver, error) {
+	var v semver
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(s), "v"), ".", 3)
+	if len(parts) != 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	for i, p := range parts {
+		// ignore pre-release and build suffixes such as 1.2.3-rc1
+		if j := strings.IndexAny(p, "-+"); j >= 0 && i == 2 {
+			p = p[:j]
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v semver) less(w semver) bool {
+	for i := range v {
+		if v[i] != w[i] {
+			return v[i] < w[i]
+		}
+	}
+	return false
+}
+
+// versionRange matches versions v with Min <= v < Max. An empty Max means
+// no upper bound.
+type versionRange struct {
+	Min, Max string
+}
+
+func (r versionRange) contains(v semver) bool {
+	min, err := parseSemver(r.Min)
+	if err != nil || v.less(min) {
+		return false
+	}
+	if r.Max == "" {
+		return true
+	}
+	max, err := parseSemver(r.Max)
+	return err == nil && v.less(max)
+}
+
+func (r versionRange) String() string {
+	if r.Max == "" {
+		return ">=" + r.Min
+	}
+	return ">=" + r.Min + " <" + r.Max
+}
+
+// checkVersion reports whether version falls in one of ranges.
+func checkVersion(what, version string, ranges []versionRange) error {
+	v, err := parseSemver(version)
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	for _, r := range ranges {
+		if r.contains(v) {
+			return nil
+		}
+	}
+	var supported []string
+	for _, r := range ranges {
+		supported = append(supported, r.String())
+	}
+	return fmt.Errorf("%s %s is not supported by CLI %s (supported: %s)", what, version, CLI_version, strings.Join(supported, ", "))
+}
+
+// checkCompatibility reads the version of the Ledger app, and of the
+// CoinDaemon unless daemon is nil, and refuses to go on when either is
+// known to be incompatible with this CLI. Versions that cannot be read are
+// only warned about.
+func checkCompatibility(ctx context.Context, nanos *NanoS, daemon *CoinDaemon) error {
+	appVersion, err := nanos.GetVersion()
+	if err != nil {
+		log.Println("Warning: couldn't read the Ledger app version:", err)
+	} else if err := checkVersion("Ledger app", appVersion, compatibleLedgerVersions); err != nil {
+		return err
+	}
+	if daemon == nil {
+		return nil
+	}
+	daemonVersion, err := daemon.Version(ctx)
+	if err != nil {
+		log.Println("Warning: couldn't read the CoinDaemon version:", err)
+	} else if err := checkVersion("CoinDaemon", daemonVersion, compatibleDaemonVersions); err != nil {
+		return err
+	}
+	return nil
+}